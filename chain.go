@@ -0,0 +1,46 @@
+package ip
+
+import (
+	"context"
+
+	"github.com/oarkflow/ip/ctx"
+)
+
+// chainContext runs the remaining handlers of a chain on Next before
+// handing over to the wrapped context
+type chainContext struct {
+	ctx.Context
+	handlers []HandlerFunc
+	index    int
+}
+
+func (c *chainContext) Next(cx context.Context) {
+	if c.index < len(c.handlers) {
+		handler := c.handlers[c.index]
+		c.index++
+		handler(cx, c)
+		return
+	}
+	c.Context.Next(cx)
+}
+
+// Chain composes middlewares into one, each continuing to the next by
+// calling Next on its context. Aborting (not calling Next) stops the chain.
+func Chain(middlewares ...HandlerFunc) HandlerFunc {
+	return func(cx context.Context, c ctx.Context) {
+		chain := &chainContext{Context: c, handlers: middlewares}
+		chain.Next(cx)
+	}
+}
+
+// DetectAndFilter chains Detect with a filter built from cfg, so the
+// filter, including its country rate limits, reuses the detected IP.
+// The IP and country are stored under the context keys of cfg.
+func DetectAndFilter(cfg ...Config) HandlerFunc {
+	var opts Config
+	if len(cfg) > 0 {
+		opts = cfg[0]
+	}
+	opts.setDefaultKeys()
+	return Chain(detectWith(opts.IPContextKey, opts.CountryContextKey), NewFilter(opts))
+}
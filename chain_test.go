@@ -0,0 +1,57 @@
+package ip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oarkflow/ip/ctx/ctxtest"
+)
+
+// restoreFilter puts the package level filter back after NewFilter
+// replaced it
+func restoreFilter(t *testing.T) {
+	t.Helper()
+	old := filter
+	t.Cleanup(func() {
+		filter.Close()
+		filter = old
+	})
+}
+
+func TestDetectAndFilterContextKeys(t *testing.T) {
+	restoreFilter(t)
+	handler := DetectAndFilter(Config{
+		IPContextKey:      "client_ip",
+		CountryContextKey: "client_country",
+		BlockedCountries:  []string{"DE"},
+	})
+
+	c := ctxtest.New(testIP)
+	handler(context.Background(), c)
+	if !c.NextCalled() {
+		t.Fatal("allowed request didn't reach the next handler")
+	}
+	values := c.Values()
+	if values["client_ip"] != testIP || values["client_country"] != testCountry {
+		t.Errorf("stored ip %v and country %v, want %s and %s", values["client_ip"], values["client_country"], testIP, testCountry)
+	}
+	for _, key := range []string{"ip", "ip_country"} {
+		if value, ok := values[key]; ok {
+			t.Errorf("stored %v under the default key %q", value, key)
+		}
+	}
+	if info, ok := FromContext(c); !ok || info.IP != testIP {
+		t.Errorf("FromContext returned %+v, %v", info, ok)
+	}
+
+	// the filter decides on the detected country
+	const germanIP = "5.1.66.255"
+	if code := Country(germanIP); code != "DE" {
+		t.Fatalf("country of %s is %q, want DE", germanIP, code)
+	}
+	blocked := ctxtest.New(germanIP)
+	handler(context.Background(), blocked)
+	if !blocked.Aborted() || blocked.NextCalled() {
+		t.Error("request from a blocked country passed")
+	}
+}
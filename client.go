@@ -0,0 +1,133 @@
+package ip
+
+import (
+	"context"
+	"net"
+
+	"github.com/oarkflow/ip/ctx"
+	"github.com/oarkflow/ip/geoip"
+)
+
+// Option configures a Client built by New.
+type Option func(*Client)
+
+// Client bundles a filter, its rate limiter and the client IP
+// detection, so an application can inject one object instead of using
+// the package level functions. Clients are independent of each other
+// and of NewFilter, except for the geo database: it is shared by the
+// whole process, so a Client never loads one, see New.
+type Client struct {
+	opts   Config
+	filter *Filter
+}
+
+// WithConfig sets the filter configuration, replacing what earlier
+// options set, later options override it.
+func WithConfig(cfg Config) Option {
+	return func(c *Client) {
+		cfg.provider = c.opts.provider
+		c.opts = cfg
+	}
+}
+
+// WithProvider makes the client read the client IP the way p passes
+// it, see geoip.UseProvider.
+func WithProvider(p geoip.Provider) Option {
+	return func(c *Client) {
+		c.opts.provider = geoip.NewProvider(p)
+	}
+}
+
+// WithLogger sets the logger of the filter.
+func WithLogger(logger interface {
+	Printf(format string, v ...interface{})
+}) Option {
+	return func(c *Client) {
+		c.opts.Logger = logger
+	}
+}
+
+// WithCountryRateLimit limits each IP of country code to perMinute
+// requests.
+func WithCountryRateLimit(code string, perMinute int) Option {
+	return func(c *Client) {
+		if c.opts.CountryRateLimits == nil {
+			c.opts.CountryRateLimits = map[string]int{}
+		}
+		c.opts.CountryRateLimits[code] = perMinute
+	}
+}
+
+// WithMetrics reports the decisions of the client to m.
+func WithMetrics(m Metrics) Option {
+	return func(c *Client) {
+		c.opts.Metrics = m
+	}
+}
+
+// WithContextKeys sets the context keys the client IP and country are
+// stored under.
+func WithContextKeys(ipKey, countryKey string) Option {
+	return func(c *Client) {
+		c.opts.IPContextKey = ipKey
+		c.opts.CountryContextKey = countryKey
+	}
+}
+
+// New builds a Client, the configuration is validated and applied the
+// same way as by NewFilter. The geo database fields IPDB, IPDBPath,
+// IPDBFetchURL and IPDBDownload are ignored, with a logged warning, as
+// loading would replace the database of every other Client and of the
+// package level functions. Load it once with NewFilter or the geoip
+// loaders instead.
+func New(opts ...Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.opts.setDefaults()
+	if len(c.opts.IPDB) > 0 || c.opts.IPDBPath != "" || c.opts.IPDBFetchURL != "" {
+		c.opts.Logger.Printf("ip client: ignoring IPDB, IPDBPath and IPDBFetchURL, the geo database is shared by the process")
+	}
+	c.filter = newFilter(c.opts)
+	return c
+}
+
+// Filter returns the filter of the client to change its rules.
+func (c *Client) Filter() *Filter {
+	return c.filter
+}
+
+// ClientIP returns the client IP of a request.
+func (c *Client) ClientIP(ct ctx.Context) string {
+	if c.opts.provider != nil {
+		return geoip.FromRequestWith(c.opts.provider, ct)
+	}
+	return geoip.FromRequest(ct)
+}
+
+// Country returns the country code of ip.
+func (c *Client) Country(ip string) string {
+	return c.filter.country(net.ParseIP(ip))
+}
+
+// Detect is a middleware storing the client IP and country like the
+// package level Detect.
+func (c *Client) Detect(cx context.Context, ct ctx.Context) {
+	info := ClientInfo{IP: c.ClientIP(ct)}
+	info.Country = c.Country(info.IP)
+	ct.Set(c.opts.IPContextKey, info.IP)
+	ct.Set(c.opts.CountryContextKey, info.Country)
+	ct.Set(clientInfoKey, info)
+	ct.Next(cx)
+}
+
+// Middleware returns the handler enforcing the filter of the client.
+func (c *Client) Middleware() HandlerFunc {
+	return c.opts.middleware(func() *Filter { return c.filter })
+}
+
+// Close stops the background work of the client.
+func (c *Client) Close() {
+	c.filter.Close()
+}
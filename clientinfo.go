@@ -0,0 +1,19 @@
+package ip
+
+// clientInfoKey is the context key Detect stores ClientInfo under. The
+// ctx.Context Set only accepts strings, so the key is namespaced by
+// the import path to stay clear of application keys.
+const clientInfoKey = "github.com/oarkflow/ip.ClientInfo"
+
+// ClientInfo is what Detect learned about the client of a request.
+type ClientInfo struct {
+	IP      string
+	Country string
+}
+
+// FromContext returns the ClientInfo stored by Detect. It accepts a
+// ctx.Context or any context.Context carrying the same values.
+func FromContext(c interface{ Value(key any) any }) (ClientInfo, bool) {
+	info, ok := c.Value(clientInfoKey).(ClientInfo)
+	return info, ok
+}
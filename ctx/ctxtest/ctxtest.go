@@ -0,0 +1,128 @@
+// Package ctxtest provides a recording ctx.Context for testing
+// middlewares and filter configurations.
+package ctxtest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/oarkflow/ip/ctx"
+)
+
+// Context is a fake ctx.Context which records what a middleware did
+// with it. The zero value is ready to use.
+type Context struct {
+	// Header is returned by GetHeader
+	Header http.Header
+	// RemoteIP is returned by ClientIP
+	RemoteIP string
+	// OnNext, when set, is called by Next, e.g. with the handler
+	// that follows the middleware under test
+	OnNext func(c context.Context, ct ctx.Context)
+
+	values    map[string]interface{}
+	abortBody interface{}
+	abortCode int
+	aborted   bool
+	nextCalls int
+	mut       sync.Mutex
+}
+
+var _ ctx.Context = (*Context)(nil)
+
+// New returns a Context for a request from remoteIP.
+func New(remoteIP string) *Context {
+	return &Context{RemoteIP: remoteIP, Header: http.Header{}}
+}
+
+// WithHeader sets a request header and returns c for chaining.
+func (c *Context) WithHeader(key, value string) *Context {
+	if c.Header == nil {
+		c.Header = http.Header{}
+	}
+	c.Header.Set(key, value)
+	return c
+}
+
+func (c *Context) AbortWithJSON(code int, jsonObj interface{}) {
+	c.mut.Lock()
+	c.aborted = true
+	c.abortCode = code
+	c.abortBody = jsonObj
+	c.mut.Unlock()
+}
+
+func (c *Context) Set(key string, value interface{}) {
+	c.mut.Lock()
+	if c.values == nil {
+		c.values = map[string]interface{}{}
+	}
+	c.values[key] = value
+	c.mut.Unlock()
+}
+
+func (c *Context) Next(cx context.Context) {
+	c.mut.Lock()
+	c.nextCalls++
+	next := c.OnNext
+	c.mut.Unlock()
+	if next != nil {
+		next(cx, c)
+	}
+}
+
+func (c *Context) GetHeader(key string) []byte {
+	return []byte(c.Header.Get(key))
+}
+
+func (c *Context) ClientIP() string {
+	return c.RemoteIP
+}
+
+func (c *Context) Value(key interface{}) interface{} {
+	k, ok := key.(string)
+	if !ok {
+		return nil
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.values[k]
+}
+
+// Values returns a copy of everything stored with Set.
+func (c *Context) Values() map[string]interface{} {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	values := make(map[string]interface{}, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Aborted reports whether AbortWithJSON was called.
+func (c *Context) Aborted() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.aborted
+}
+
+// Abort returns the status code and payload of the last AbortWithJSON.
+func (c *Context) Abort() (int, interface{}) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.abortCode, c.abortBody
+}
+
+// NextCalled reports whether Next ran, i.e. the request passed through.
+func (c *Context) NextCalled() bool {
+	return c.NextCalls() > 0
+}
+
+// NextCalls returns how many times Next ran.
+func (c *Context) NextCalls() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.nextCalls
+}
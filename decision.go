@@ -0,0 +1,80 @@
+package ip
+
+import (
+	"time"
+
+	"github.com/oarkflow/ip/geoip"
+)
+
+// Decision is a request decided by the filter, as passed to
+// Config.DecisionHook.
+type Decision struct {
+	IP string `json:"ip"`
+	// Country is empty when deciding didn't need a country lookup
+	Country     string `json:"country,omitempty"`
+	Allowed     bool   `json:"allowed"`
+	RateLimited bool   `json:"rate_limited"`
+	// SampleRate is N when only 1 in N allowed decisions reach the
+	// hook, 1 for denied ones which always do
+	SampleRate int       `json:"sample_rate"`
+	Time       time.Time `json:"time"`
+}
+
+// filterMetrics are the instruments of a filter
+type filterMetrics struct {
+	decisions Counter
+	duration  Histogram
+}
+
+// Metrics, Counter and Histogram are the metrics interfaces of geoip,
+// aliased for Config.Metrics.
+type (
+	Metrics   = geoip.Metrics
+	Counter   = geoip.Counter
+	Histogram = geoip.Histogram
+)
+
+func newFilterMetrics(m geoip.Metrics) *filterMetrics {
+	if m == nil {
+		return nil
+	}
+	return &filterMetrics{
+		decisions: m.Counter("ip_filter_decisions_total", "Filter decisions.", "result"),
+		duration:  m.Histogram("ip_filter_decision_seconds", "Filter decision durations.", "result"),
+	}
+}
+
+// decided reports a decision which started at start to the metrics
+// and the DecisionHook. Allowed decisions are sampled 1 in
+// DecisionSampleRate for the hook and the duration histogram, the
+// decision counter counts all of them.
+func (f *Filter) decided(ip, code string, allowed, rateLimited bool, start time.Time) {
+	rate, sampled := 1, true
+	if allowed && f.opts.DecisionSampleRate > 1 {
+		rate = f.opts.DecisionSampleRate
+		sampled = f.allowedDecisions.Add(1)%uint64(rate) == 1
+	}
+	if m := f.metrics; m != nil {
+		result := "allowed"
+		if rateLimited {
+			result = "rate_limited"
+		} else if !allowed {
+			result = "denied"
+		}
+		m.decisions.Add(1, result)
+		if sampled {
+			m.duration.Observe(time.Since(start).Seconds(), result)
+		}
+	}
+	if f.opts.DecisionHook == nil || !sampled {
+		return
+	}
+	f.opts.DecisionHook(Decision{
+		IP:          ip,
+		Country:     code,
+		Allowed:     allowed,
+		RateLimited: rateLimited,
+		SampleRate:  rate,
+		Time:        time.Now(),
+	})
+}
@@ -0,0 +1,54 @@
+package ip
+
+import (
+	"strings"
+)
+
+// Flag returns the regional indicator emoji of an ISO 3166-1 alpha-2
+// country code, e.g. "NP" gives 🇳🇵. Returns an empty string for codes
+// that are not two letters and for the unknown country "ZZ".
+func Flag(countryCode string) string {
+	if len(countryCode) != 2 || strings.EqualFold(countryCode, "ZZ") {
+		return ""
+	}
+	var flag strings.Builder
+	for _, c := range strings.ToUpper(countryCode) {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		flag.WriteRune(0x1F1E6 + c - 'A')
+	}
+	return flag.String()
+}
+
+// Location is a place to display, any of its fields may be empty.
+type Location struct {
+	City        string
+	Region      string
+	Country     string
+	CountryCode string
+}
+
+// DisplayLocation formats a location as "Kathmandu, Bagmati, Nepal 🇳🇵",
+// skipping empty fields. The country code is shown when the country
+// name is unknown.
+func DisplayLocation(loc Location) string {
+	country := loc.Country
+	if country == "" {
+		country = loc.CountryCode
+	}
+	var parts []string
+	for _, part := range []string{loc.City, loc.Region, country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	display := strings.Join(parts, ", ")
+	if flag := Flag(loc.CountryCode); flag != "" {
+		if display != "" {
+			display += " "
+		}
+		display += flag
+	}
+	return display
+}
@@ -0,0 +1,33 @@
+package ip
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidCIDR is returned for rules which are not an IP, CIDR,
+	// wildcard, range or host name
+	ErrInvalidCIDR = errors.New("invalid IP or CIDR")
+	// ErrUnresolvableHost is returned for host names given as IP rules
+	// which don't resolve
+	ErrUnresolvableHost = errors.New("unresolvable host")
+	// ErrUnknownCountryCode is returned for country codes missing from
+	// the geo database
+	ErrUnknownCountryCode = errors.New("unknown country code")
+)
+
+// RuleError is returned by the rule mutating methods, it wraps one of
+// the errors above with the offending rule.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("ip filter: %v %q", e.Err, e.Rule)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
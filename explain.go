@@ -0,0 +1,56 @@
+package ip
+
+import (
+	"net"
+)
+
+// Explanation is the evaluation trace of a single filter decision,
+// describing which rules matched and which one decided the outcome.
+type Explanation struct {
+	// IP is the address as given to Explain
+	IP string `json:"ip"`
+	// IPRule is set when a single IP rule matched
+	IPRule *bool `json:"ip_rule,omitempty"`
+	// HostRule is set when the IP belongs to a host rule
+	HostRule *bool `json:"host_rule,omitempty"`
+	// Subnets lists every subnet rule containing the IP
+	Subnets []SubnetMatch `json:"subnets,omitempty"`
+	// Country is the country code found for the IP, if it was looked up
+	Country string `json:"country,omitempty"`
+	// CountryRule is set when a country rule matched
+	CountryRule *bool `json:"country_rule,omitempty"`
+	// RateLimit is the per minute limit of the country whose rule
+	// allowed the request, if any
+	RateLimit int `json:"rate_limit,omitempty"`
+	// DecidedBy names the step which produced the outcome
+	DecidedBy string `json:"decided_by"`
+	Allowed   bool   `json:"allowed"`
+}
+
+// SubnetMatch is a subnet rule containing the explained IP
+type SubnetMatch struct {
+	CIDR    string `json:"cidr"`
+	Allowed bool   `json:"allowed"`
+}
+
+// Explain returns the full evaluation trace for a given IP, i.e. why
+// Allowed would return what it returns
+func (f *Filter) Explain(ipStr string) Explanation {
+	e := Explanation{IP: ipStr}
+	e.Allowed, _, _ = f.evaluate(net.ParseIP(ipStr), &e)
+	return e
+}
+
+func (e *Explanation) recordSubnet(allowed bool) {
+	if allowed {
+		e.record("subnet allow rule")
+	} else {
+		e.record("subnet block rule")
+	}
+}
+
+func (e *Explanation) record(step string) {
+	if e != nil {
+		e.DecidedBy = step
+	}
+}
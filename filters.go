@@ -1,11 +1,16 @@
 package ip
 
 import (
+	"bufio"
 	"context"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oarkflow/ip/consts"
 	"github.com/oarkflow/ip/ctx"
@@ -16,82 +21,326 @@ type HandlerFunc func(c context.Context, ctx ctx.Context)
 
 // Config for Filter. Allow supersedes Block for IP checks
 // across all matching subnets, whereas country checks use the
-// latest Allow/Block setting.
+// latest Allow/Block setting. Single IPs are checked first, then
+// subnets and then countries, Precedence changes the order of the
+// latter two.
 // IPs can be IPv4 or IPv6 and can optionally contain subnet
-// masks (e.g. /24). Note however, determining if a given IP is
-// included in a subnet requires a linear scan so is less performant
-// than looking up single IPs.
+// masks (e.g. /24), trailing wildcards (e.g. 10.1.*.*) or ranges
+// (e.g. 192.168.1.10-192.168.1.50). Fully qualified host names are
+// added as host rules, see AllowedHosts. Note however, determining if
+// a given IP is included in a subnet requires a linear scan so is less
+// performant than looking up single IPs.
 //
 // This could be improved with cidr range prefix tree.
+//
+// Countries listed in CountryRateLimits are not blocked but each IP
+// from them is limited to the given number of requests per minute;
+// RateLimitHandler is called once the limit is exceeded. The limit only
+// applies when the country rule decides, an IP let through by a single
+// IP, host or subnet rule isn't limited.
+//
+// When deciding requires a country lookup, the country code is stored
+// in the request context under CountryContextKey ("ip_country" by
+// default) so later handlers don't need to look it up again.
+//
+// IPv6PrefixFallback retries IPv6 addresses without a country with
+// their enclosing /48 and /32, see geoip.CountryByIPFallback.
+//
+// IPDBDownload customizes the download of IPDBFetchURL, e.g. with a
+// proxy, User-Agent or credentials. IPDBAttributions are the notices
+// of the CSV at IPDBPath or IPDBFetchURL, see geoip.LoadDBIPReader. A
+// failed download is retried after IPDBRetryInterval
+// (DefaultIPDBRetryInterval when zero), doubling up to
+// MaxIPDBRetryInterval, until it succeeds or the filter is closed.
+//
+// FailMode decides requests needing a country while the configured geo
+// database (IPDB, IPDBPath or IPDBFetchURL) failed to load or is still
+// downloading. Rules from WarmAllowlistPath, a file with one IP rule
+// per line, are allowed before anything else is loaded.
+//
+// AllowedHosts and BlockedHosts are DNS names whose addresses are
+// re-resolved every HostResolveInterval (DefaultHostResolveInterval
+// when zero). They are resolved concurrently when the filter is built,
+// hosts failing to resolve are logged and retried at the next interval.
+//
+// BlockAnonymousProxies (public and residential proxies, Tor exit
+// nodes) and BlockVPNs look addresses up in AnonymousIP, or else in
+// the GeoIP2 Anonymous IP database at AnonymousIPPath. They are
+// checked after single IP and host rules, so those can let an address
+// through regardless.
+//
+// DecisionHook, when set, is called with every denied request and,
+// to keep the volume manageable at high traffic, 1 in
+// DecisionSampleRate allowed ones (all when zero). Metrics, when set,
+// counts every decision and times the ones sampled for the hook, see
+// geoip.SetMetrics for the metrics of the geo database.
 type Config struct {
 	Logger interface {
 		Printf(format string, v ...interface{})
 	}
-	ErrorHandler     HandlerFunc
-	IPDBFetchURL     string
-	IPDBPath         string
-	IPContextKey     string
-	IPDB             []byte
-	BlockedCountries []string
-	AllowedCountries []string
-	BlockedIPs       []string
-	AllowedIPs       []string
-	BlockByDefault   bool
-	TrustProxy       bool
-	IPDBNoFetch      bool
+	ErrorHandler          HandlerFunc
+	RateLimitHandler      HandlerFunc
+	DecisionHook          func(Decision)
+	DecisionSampleRate    int
+	Metrics               geoip.Metrics
+	CountryRateLimits     map[string]int
+	HostResolveInterval   time.Duration
+	AnonymousIP           geoip.AnonymousIPProvider
+	AnonymousIPPath       string
+	IPDBDownload          geoip.DownloadConfig
+	IPDBFetchURL          string
+	IPDBRetryInterval     time.Duration
+	IPDBPath              string
+	IPDBAttributions      []geoip.Attribution
+	IPContextKey          string
+	CountryContextKey     string
+	IPDB                  []byte
+	BlockedCountries      []string
+	AllowedCountries      []string
+	BlockedIPs            []string
+	AllowedIPs            []string
+	BlockedHosts          []string
+	AllowedHosts          []string
+	FailMode              FailMode
+	Precedence            Precedence
+	WarmAllowlistPath     string
+	BlockByDefault        bool
+	IPv6PrefixFallback    bool
+	TrustProxy            bool
+	IPDBNoFetch           bool
+	BlockAnonymousProxies bool
+	BlockVPNs             bool
+
+	// provider detects the client IP for a Client
+	provider *geoip.Provider
 }
 
+// Precedence orders the subnet and country rules, single IP and host
+// rules always come first.
+type Precedence int
+
+const (
+	// PrecedenceIPSubnetCountry lets any matching subnet decide before
+	// the country rules (default)
+	PrecedenceIPSubnetCountry Precedence = iota
+	// PrecedenceIPCountrySubnet lets a matching country rule decide
+	// before the subnets
+	PrecedenceIPCountrySubnet
+	// PrecedenceAllowWins allows a request when any subnet or country
+	// rule allows it, e.g. to let a partner ISP's country allow
+	// override a subnet block, and blocks it only otherwise
+	PrecedenceAllowWins
+)
+
+// FailMode is how the filter decides when the geo database is unavailable.
+type FailMode string
+
+const (
+	// FailModeEmbedded falls back to the embedded database (default)
+	FailModeEmbedded FailMode = ""
+	// FailModeAllow allows requests reaching the country rules
+	FailModeAllow FailMode = "allow"
+	// FailModeDeny blocks requests reaching the country rules
+	FailModeDeny FailMode = "deny"
+	// FailModeCountrySkip skips country rules and uses the default
+	FailModeCountrySkip FailMode = "country-skip"
+)
+
 type Filter struct {
-	ips            map[string]bool
-	codes          map[string]bool
-	opts           Config
-	subnets        []*subnet
-	mut            sync.RWMutex
-	defaultAllowed bool
+	ips          map[string]bool
+	hosts        map[string]*hostRule
+	hostIPs      map[string]*hostRule
+	ipStats      map[string]*ruleStat
+	codeStats    map[string]*ruleStat
+	stopHosts    chan struct{}
+	stopDownload chan struct{}
+	codes        map[string]bool
+	limits       map[string]int
+	// preLimit is the country rule LimitCountry replaced, restored
+	// when the limit is removed
+	preLimit      map[string]countryRule
+	limiter       *rateLimiter
+	dbUnavailable atomic.Bool
+	opts          Config
+	subnets       []*subnet
+	anonymous     geoip.AnonymousIPProvider
+	// allowedDecisions counts allowed decisions for sampling
+	allowedDecisions atomic.Uint64
+	metrics          *filterMetrics
+	mut              sync.RWMutex
+	defaultAllowed   bool
+}
+
+// countryRule is the allow/block state of a country, set is false
+// when the country had no rule
+type countryRule struct {
+	allowed, set bool
 }
 
 type subnet struct {
+	stat    ruleStat
 	ipNet   *net.IPNet
 	str     string
 	allowed bool
 }
 
 var filter = &Filter{
-	ips:   map[string]bool{},
-	codes: map[string]bool{},
+	ips:       map[string]bool{},
+	hosts:     map[string]*hostRule{},
+	hostIPs:   map[string]*hostRule{},
+	ipStats:   map[string]*ruleStat{},
+	codeStats: map[string]*ruleStat{},
+	codes:     map[string]bool{},
+	limits:    map[string]int{},
+	preLimit:  map[string]countryRule{},
+	limiter:   newRateLimiter(time.Minute),
 }
 
-// NewFilter constructs Filter instance without downloading DB.
+const (
+	// DefaultIPDBRetryInterval is the delay before retrying a failed
+	// download of Config.IPDBFetchURL when IPDBRetryInterval is not set
+	DefaultIPDBRetryInterval = 30 * time.Second
+	// MaxIPDBRetryInterval caps the doubling delay between retries
+	MaxIPDBRetryInterval = 30 * time.Minute
+)
+
+// NewFilter constructs Filter instance. When Config.IPDBFetchURL is set
+// and IPDBNoFetch is not, the geo database is downloaded in the
+// background and the embedded one is used until it is loaded.
 func NewFilter(cfg ...Config) func(ctx context.Context, c ctx.Context) {
 	var opts Config
 	if len(cfg) > 0 {
 		opts = cfg[0]
 	}
+	opts.setDefaults()
+	// the previous filter is no longer reachable
+	filter.Close()
+	filter = newFilter(opts)
+	filter.loadIPDB()
+	return opts.middleware(func() *Filter { return filter })
+}
+
+// setDefaults logs the issues of opts and fills in the defaults shared
+// by NewFilter and New
+func (opts *Config) setDefaults() {
 	if opts.Logger == nil {
 		// disable logging by default
 		opts.Logger = log.New(io.Discard, "", 0)
 	}
-	filter = &Filter{
+	for _, issue := range opts.Validate() {
+		opts.Logger.Printf("ip filter config: %s", issue)
+	}
+	opts.setDefaultKeys()
+	opts.setDefaultHandlers()
+}
+
+// setDefaultKeys defaults the context keys to the ones Detect uses
+func (opts *Config) setDefaultKeys() {
+	if opts.CountryContextKey == "" {
+		opts.CountryContextKey = "ip_country"
+	}
+	if opts.IPContextKey == "" {
+		opts.IPContextKey = "ip"
+	}
+}
+
+// newFilter builds a filter from opts with setDefaults applied. It
+// doesn't load the geo database, which is shared by the process.
+func newFilter(opts Config) *Filter {
+	filter := &Filter{
 		opts:           opts,
 		ips:            map[string]bool{},
+		hosts:          map[string]*hostRule{},
+		hostIPs:        map[string]*hostRule{},
+		ipStats:        map[string]*ruleStat{},
+		codeStats:      map[string]*ruleStat{},
 		codes:          map[string]bool{},
+		limits:         map[string]int{},
+		preLimit:       map[string]countryRule{},
+		limiter:        newRateLimiter(time.Minute),
 		defaultAllowed: !opts.BlockByDefault,
 	}
+	if opts.WarmAllowlistPath != "" {
+		if err := filter.loadWarmAllowlist(opts.WarmAllowlistPath); err != nil {
+			opts.Logger.Printf("ip filter: loading warm allowlist: %v", err)
+		}
+	}
+	filter.metrics = newFilterMetrics(opts.Metrics)
+	filter.anonymous = opts.AnonymousIP
+	if filter.anonymous == nil && opts.AnonymousIPPath != "" {
+		db, err := geoip.OpenAnonymousIP(opts.AnonymousIPPath)
+		if err != nil {
+			opts.Logger.Printf("ip filter: loading anonymous ip database: %v", err)
+		} else {
+			filter.anonymous = db
+		}
+	}
+	// host names listed as IPs are resolved with the host rules
+	blockedHosts := append([]string(nil), opts.BlockedHosts...)
 	for _, ip := range opts.BlockedIPs {
+		if isHostName(ip) {
+			blockedHosts = append(blockedHosts, ip)
+			continue
+		}
 		filter.BlockIP(ip)
 	}
+	allowedHosts := append([]string(nil), opts.AllowedHosts...)
 	for _, ip := range opts.AllowedIPs {
+		if isHostName(ip) {
+			allowedHosts = append(allowedHosts, ip)
+			continue
+		}
 		filter.AllowIP(ip)
 	}
+	filter.addHosts(blockedHosts, allowedHosts)
 	for _, code := range opts.BlockedCountries {
 		filter.BlockCountry(code)
 	}
 	for _, code := range opts.AllowedCountries {
 		filter.AllowCountry(code)
 	}
+	for code, perMinute := range opts.CountryRateLimits {
+		filter.LimitCountry(code, perMinute)
+	}
+	return filter
+}
+
+// middleware returns the handler enforcing the filter returned by
+// current, which NewFilter may replace
+func (opts Config) middleware(current func() *Filter) HandlerFunc {
 	if opts.IPContextKey == "" {
 		opts.IPContextKey = "ip"
 	}
+	opts.setDefaultHandlers()
+	return func(ctx context.Context, c ctx.Context) {
+		start := time.Now()
+		filter := current()
+		remoteIP := opts.remoteIP(c)
+		allowed, limitCode, byCountry := filter.allowedContext(c, remoteIP)
+		// special case localhost ipv4
+		if !allowed && remoteIP == "::1" && filter.Allowed("127.0.0.1") {
+			allowed, byCountry = true, false
+		}
+		code, _ := c.Value(opts.CountryContextKey).(string)
+		if !allowed {
+			filter.decided(remoteIP, code, false, false, start)
+			opts.ErrorHandler(ctx, c)
+			return
+		}
+		// only requests a country rule let through are rate limited
+		if byCountry && filter.rateLimited(remoteIP, limitCode) {
+			filter.decided(remoteIP, code, false, true, start)
+			opts.RateLimitHandler(ctx, c)
+			return
+		}
+		filter.decided(remoteIP, code, true, false, start)
+		// success!
+		c.Next(ctx)
+	}
+}
+
+// setDefaultHandlers fills in the JSON error and rate limit handlers
+func (opts *Config) setDefaultHandlers() {
 	if opts.ErrorHandler == nil {
 		opts.ErrorHandler = func(c context.Context, ct ctx.Context) {
 			ct.AbortWithJSON(consts.StatusServiceUnavailable, map[string]any{
@@ -100,27 +349,122 @@ func NewFilter(cfg ...Config) func(ctx context.Context, c ctx.Context) {
 			})
 		}
 	}
-	return func(ctx context.Context, c ctx.Context) {
-		var remoteIP string
-		rIP := c.Value(opts.IPContextKey)
-		if rIP != nil {
-			remoteIP = rIP.(string)
-		} else {
-			remoteIP = geoip.FromRequest(c)
-			c.Set(opts.IPContextKey, remoteIP)
+	if opts.RateLimitHandler == nil {
+		opts.RateLimitHandler = func(c context.Context, ct ctx.Context) {
+			ct.AbortWithJSON(consts.StatusTooManyRequests, map[string]any{
+				"error":   true,
+				"message": consts.StatusTooManyRequests,
+			})
 		}
-		allowed := filter.Allowed(remoteIP)
-		// special case localhost ipv4
-		if !allowed && remoteIP == "::1" && filter.Allowed("127.0.0.1") {
-			allowed = true
+	}
+}
+
+// remoteIP returns the IP stored under IPContextKey, detecting and
+// storing it when missing
+func (opts *Config) remoteIP(c ctx.Context) string {
+	if rIP := c.Value(opts.IPContextKey); rIP != nil {
+		return rIP.(string)
+	}
+	remoteIP := geoip.FromRequest(c)
+	if opts.provider != nil {
+		remoteIP = geoip.FromRequestWith(opts.provider, c)
+	}
+	c.Set(opts.IPContextKey, remoteIP)
+	return remoteIP
+}
+
+// loadIPDB loads the configured geo database, marking it unavailable
+// for FailMode until it is loaded. A download runs in the background.
+func (f *Filter) loadIPDB() {
+	opts := f.opts
+	configured := len(opts.IPDB) > 0 || opts.IPDBPath != ""
+	fetch := opts.IPDBFetchURL != "" && !opts.IPDBNoFetch
+	err := loadIPDBSource(opts)
+	if err != nil {
+		opts.Logger.Printf("ip filter: loading geo database: %v", err)
+	}
+	f.dbUnavailable.Store((configured || fetch) && (!configured || err != nil))
+	if !fetch {
+		return
+	}
+	download := opts.IPDBDownload
+	download.URL = opts.IPDBFetchURL
+	if len(download.Attributions) == 0 {
+		download.Attributions = opts.IPDBAttributions
+	}
+	f.mut.Lock()
+	f.stopDownload = make(chan struct{})
+	go f.downloadIPDB(f.stopDownload, download)
+	f.mut.Unlock()
+}
+
+// downloadIPDB downloads the geo database, retrying with backoff until
+// it succeeds or stop is closed
+func (f *Filter) downloadIPDB(stop <-chan struct{}, download geoip.DownloadConfig) {
+	retry := f.opts.IPDBRetryInterval
+	if retry <= 0 {
+		retry = DefaultIPDBRetryInterval
+	}
+	for {
+		err := geoip.Download(context.Background(), download)
+		if err == nil {
+			f.dbUnavailable.Store(false)
+			return
 		}
-		if !allowed {
-			opts.ErrorHandler(ctx, c)
+		f.opts.Logger.Printf("ip filter: downloading geo database: %v, retrying in %v", err, retry)
+		timer := time.NewTimer(retry)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
 			return
 		}
-		// success!
-		c.Next(ctx)
+		retry = min(retry*2, MaxIPDBRetryInterval)
+	}
+}
+
+// loadWarmAllowlist allows every IP rule of a file, one per line with
+// # comments, before the geo database is ready
+func (f *Filter) loadWarmAllowlist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var hosts []string
+	for scanner.Scan() {
+		rule, _, _ := strings.Cut(scanner.Text(), "#")
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		if isHostName(rule) {
+			hosts = append(hosts, rule)
+			continue
+		}
+		if err := f.AllowIPE(rule); err != nil {
+			f.opts.Logger.Printf("ip filter: warm allowlist: %v", err)
+		}
 	}
+	f.addHosts(nil, hosts)
+	return scanner.Err()
+}
+
+// loadIPDBSource replaces the embedded geo database with Config.IPDB, a
+// cache written by geoip.WriteCache, or the CSV file at Config.IPDBPath
+func loadIPDBSource(opts Config) error {
+	if len(opts.IPDB) > 0 {
+		return geoip.LoadCacheBytes(opts.IPDB)
+	}
+	if opts.IPDBPath == "" {
+		return nil
+	}
+	file, err := os.Open(opts.IPDBPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return geoip.LoadDBIPReader(file, opts.IPDBAttributions...)
 }
 
 func (f *Filter) AllowIP(ip string) bool {
@@ -132,14 +476,33 @@ func (f *Filter) BlockIP(ip string) bool {
 }
 
 func (f *Filter) ToggleIP(str string, allowed bool) bool {
+	return f.ToggleIPE(str, allowed) == nil
+}
+
+// AllowIPE is AllowIP returning ErrInvalidCIDR for invalid rules
+func (f *Filter) AllowIPE(ip string) error {
+	return f.ToggleIPE(ip, true)
+}
+
+// BlockIPE is BlockIP returning ErrInvalidCIDR for invalid rules
+func (f *Filter) BlockIPE(ip string) error {
+	return f.ToggleIPE(ip, false)
+}
+
+// ToggleIPE is ToggleIP returning ErrInvalidCIDR for invalid rules.
+// Fully qualified host names become host rules, see ToggleHost. They
+// are resolved before returning and ErrUnresolvableHost is returned,
+// without adding the rule, when the lookup fails.
+func (f *Filter) ToggleIPE(str string, allowed bool) error {
 	// check if has subnet
 	if ip, nt, err := net.ParseCIDR(str); err == nil {
 		// containing only one ip? (no bits masked)
 		if n, total := nt.Mask.Size(); n == total {
 			f.mut.Lock()
 			f.ips[ip.String()] = allowed
+			statOf(f.ipStats, ip.String())
 			f.mut.Unlock()
-			return true
+			return nil
 		}
 		// check for existing
 		f.mut.Lock()
@@ -159,16 +522,32 @@ func (f *Filter) ToggleIP(str string, allowed bool) bool {
 			})
 		}
 		f.mut.Unlock()
-		return true
+		return nil
 	}
 	// check if plain ip (/32)
 	if ip := net.ParseIP(str); ip != nil {
 		f.mut.Lock()
 		f.ips[ip.String()] = allowed
+		statOf(f.ipStats, ip.String())
 		f.mut.Unlock()
-		return true
+		return nil
+	}
+	// check for wildcard (10.1.*.*) or range (10.0.0.1-10.0.0.9)
+	if cidrs, ok := expandIPRule(str); ok {
+		for _, cidr := range cidrs {
+			_ = f.ToggleIPE(cidr, allowed)
+		}
+		return nil
 	}
-	return false
+	if isHostName(str) {
+		ips, err := resolveHost(str)
+		if err != nil {
+			return &RuleError{Rule: str, Err: ErrUnresolvableHost}
+		}
+		f.setHost(str, allowed, ips, nil)
+		return nil
+	}
+	return &RuleError{Rule: str, Err: ErrInvalidCIDR}
 }
 
 func (f *Filter) AllowCountry(code string) {
@@ -183,9 +562,63 @@ func (f *Filter) BlockCountry(code string) {
 func (f *Filter) ToggleCountry(code string, allowed bool) {
 	f.mut.Lock()
 	f.codes[code] = allowed
+	if _, ok := f.preLimit[code]; ok {
+		f.preLimit[code] = countryRule{allowed: allowed, set: true}
+	}
+	statOf(f.codeStats, code)
 	f.mut.Unlock()
 }
 
+// AllowCountryE is AllowCountry returning ErrUnknownCountryCode for
+// codes missing from the geo database
+func (f *Filter) AllowCountryE(code string) error {
+	return f.ToggleCountryE(code, true)
+}
+
+// BlockCountryE is BlockCountry returning ErrUnknownCountryCode for
+// codes missing from the geo database
+func (f *Filter) BlockCountryE(code string) error {
+	return f.ToggleCountryE(code, false)
+}
+
+// ToggleCountryE is ToggleCountry returning ErrUnknownCountryCode for
+// codes missing from the geo database, which are left unchanged
+func (f *Filter) ToggleCountryE(code string, allowed bool) error {
+	if !geoip.KnownCountry(code) {
+		return &RuleError{Rule: code, Err: ErrUnknownCountryCode}
+	}
+	f.ToggleCountry(code, allowed)
+	return nil
+}
+
+// LimitCountry allows a country but rate limits each of its IPs to
+// perMinute requests. A perMinute of zero or less removes the limit
+// and restores the rule the country had before it was limited, or the
+// one set with ToggleCountry since.
+func (f *Filter) LimitCountry(code string, perMinute int) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if perMinute > 0 {
+		if _, ok := f.preLimit[code]; !ok {
+			allowed, set := f.codes[code]
+			f.preLimit[code] = countryRule{allowed: allowed, set: set}
+		}
+		f.codes[code] = true
+		statOf(f.codeStats, code)
+		f.limits[code] = perMinute
+		return
+	}
+	if rule, ok := f.preLimit[code]; ok {
+		if rule.set {
+			f.codes[code] = rule.allowed
+		} else {
+			delete(f.codes, code)
+		}
+		delete(f.preLimit, code)
+	}
+	delete(f.limits, code)
+}
+
 // ToggleDefault alters the default setting
 func (f *Filter) ToggleDefault(allowed bool) {
 	f.mut.Lock()
@@ -198,11 +631,42 @@ func (f *Filter) Allowed(ipStr string) bool {
 	return f.NetAllowed(net.ParseIP(ipStr))
 }
 
+// AllowedContext returns if a given IP can pass through the filter and
+// stores the country code in c when the decision needed it
+func (f *Filter) AllowedContext(c ctx.Context, ipStr string) bool {
+	allowed, _, _ := f.allowedContext(c, ipStr)
+	return allowed
+}
+
+// allowedContext is AllowedContext also returning the results of
+// evaluate
+func (f *Filter) allowedContext(c ctx.Context, ipStr string) (bool, string, bool) {
+	allowed, code, byCountry := f.evaluate(net.ParseIP(ipStr), nil)
+	if code != "" {
+		key := f.opts.CountryContextKey
+		if key == "" {
+			key = "ip_country"
+		}
+		c.Set(key, code)
+	}
+	return allowed, code, byCountry
+}
+
 // NetAllowed returns if a given net.IP can pass through the filter
 func (f *Filter) NetAllowed(ip net.IP) bool {
+	allowed, _, _ := f.evaluate(ip, nil)
+	return allowed
+}
+
+// evaluate runs the filter rules against ip, recording each step
+// into e when it is not nil. It also returns the country code of ip
+// when the country rules had to be checked, and whether a country rule
+// decided, which is when the country rate limit applies.
+func (f *Filter) evaluate(ip net.IP, e *Explanation) (bool, string, bool) {
 	// invalid ip
 	if ip == nil {
-		return false
+		e.record("invalid ip")
+		return false, "", false
 	}
 	// read lock entire function
 	// except for db access
@@ -211,30 +675,171 @@ func (f *Filter) NetAllowed(ip net.IP) bool {
 	// check single ips
 	allowed, ok := f.ips[ip.String()]
 	if ok {
-		return allowed
+		if e != nil {
+			e.IPRule = &allowed
+		} else {
+			lookupStat(f.ipStats, ip.String()).hit()
+		}
+		e.record("single ip rule")
+		return allowed, "", false
+	}
+	// check addresses of host rules
+	if rule, ok := f.hostIPs[ip.String()]; ok {
+		allowed := rule.allowed
+		if e != nil {
+			e.HostRule = &allowed
+		} else {
+			rule.stat.hit()
+		}
+		e.record("host rule")
+		return allowed, "", false
+	}
+	if f.anonymousBlocked(ip) {
+		e.record("anonymous ip")
+		return false, "", false
+	}
+	matchedSubnet := f.matchSubnets(ip, e)
+	subnetMatched := matchedSubnet != nil
+	subnetAllowed := subnetMatched && matchedSubnet.allowed
+	if subnetMatched && f.opts.Precedence == PrecedenceIPSubnetCountry {
+		return f.subnetDecides(matchedSubnet, e), "", false
+	}
+	countryMatched, countryAllowed, code := f.matchCountry(ip, e)
+	switch f.opts.Precedence {
+	case PrecedenceIPCountrySubnet:
+		if countryMatched {
+			return f.countryDecides(code, countryAllowed, e), code, true
+		}
+	case PrecedenceAllowWins:
+		if subnetAllowed {
+			return f.subnetDecides(matchedSubnet, e), code, false
+		}
+		if countryMatched && (countryAllowed || !subnetMatched) {
+			return f.countryDecides(code, countryAllowed, e), code, true
+		}
+	default:
+		if countryMatched {
+			return f.countryDecides(code, countryAllowed, e), code, true
+		}
+	}
+	if subnetMatched {
+		return f.subnetDecides(matchedSubnet, e), code, false
+	}
+	// use default setting
+	e.record("default")
+	return f.defaultAllowed, code, false
+}
+
+// anonymousBlocked reports if ip is a proxy or VPN blocked by
+// BlockAnonymousProxies or BlockVPNs
+func (f *Filter) anonymousBlocked(ip net.IP) bool {
+	if f.anonymous == nil || !(f.opts.BlockAnonymousProxies || f.opts.BlockVPNs) {
+		return false
 	}
-	// scan subnets for any allow/block
-	blocked := false
+	info, ok := f.anonymous.AnonymousIP(ip)
+	if !ok {
+		return false
+	}
+	if f.opts.BlockAnonymousProxies && (info.IsPublicProxy || info.IsResidentialProxy || info.IsTorExitNode) {
+		return true
+	}
+	return f.opts.BlockVPNs && info.IsAnonymousVPN
+}
+
+// matchSubnets scans subnets for any allow/block and returns the first
+// allowing subnet, or else the first blocking one, as an allow
+// supersedes blocks. An explanation keeps scanning to list every
+// matching subnet.
+func (f *Filter) matchSubnets(ip net.IP, e *Explanation) *subnet {
+	var matched *subnet
 	for _, subnet := range f.subnets {
 		if subnet.ipNet.Contains(ip) {
-			if subnet.allowed {
-				return true
+			if e != nil {
+				e.Subnets = append(e.Subnets, SubnetMatch{CIDR: subnet.str, Allowed: subnet.allowed})
+			}
+			if matched == nil || (subnet.allowed && !matched.allowed) {
+				matched = subnet
+			}
+			if subnet.allowed && e == nil {
+				break
 			}
-			blocked = true
 		}
 	}
-	if blocked {
-		return false
+	return matched
+}
+
+// subnetDecides records the decision of a subnet rule
+func (f *Filter) subnetDecides(s *subnet, e *Explanation) bool {
+	if e == nil {
+		s.stat.hit()
+	}
+	e.recordSubnet(s.allowed)
+	return s.allowed
+}
+
+// countryDecides records the decision of a country rule, or of the
+// FailMode when the geo database is unavailable (empty code)
+func (f *Filter) countryDecides(code string, allowed bool, e *Explanation) bool {
+	if e == nil && code != "" {
+		lookupStat(f.codeStats, code).hit()
+	}
+	if e != nil && allowed {
+		e.RateLimit = f.limits[code]
+	}
+	return allowed
+}
+
+// matchCountry checks the country rules, which FailMode replaces while
+// the configured geo database is unavailable. When matched, the step
+// is recorded into e.
+func (f *Filter) matchCountry(ip net.IP, e *Explanation) (matched, allowed bool, code string) {
+	// the configured geo database isn't loaded (yet)
+	if f.dbUnavailable.Load() && f.opts.FailMode != FailModeEmbedded {
+		switch f.opts.FailMode {
+		case FailModeAllow, FailModeDeny:
+			e.record("geo database unavailable")
+			return true, f.opts.FailMode == FailModeAllow, ""
+		}
+		return false, false, ""
 	}
 	// check country codes
-	code := geoip.CountryByIP(ip)
+	code = f.country(ip)
+	if e != nil {
+		e.Country = code
+	}
 	if code != "" {
 		if allowed, ok := f.codes[code]; ok {
-			return allowed
+			if e != nil {
+				e.CountryRule = &allowed
+			}
+			e.record("country rule")
+			return true, allowed, code
 		}
 	}
-	// use default setting
-	return f.defaultAllowed
+	return false, false, code
+}
+
+// country looks up the country of ip, with the IPv6 prefix fallback
+// when enabled
+func (f *Filter) country(ip net.IP) string {
+	if f.opts.IPv6PrefixFallback {
+		return geoip.CountryByIPFallback(ip)
+	}
+	return geoip.CountryByIP(ip)
+}
+
+// rateLimited counts a request from ipStr against the limit of country
+// code and returns true once the limit is exceeded. It is only called
+// for requests a country rule allowed, IP, host and subnet rules
+// aren't limited.
+func (f *Filter) rateLimited(ipStr, code string) bool {
+	f.mut.RLock()
+	limit, ok := f.limits[code]
+	f.mut.RUnlock()
+	if !ok {
+		return false
+	}
+	return !f.limiter.allow(ipStr, limit)
 }
 
 // Blocked returns if a given IP can NOT pass through the filter
@@ -267,6 +872,21 @@ func ToggleIP(str string, allowed bool) bool {
 	return filter.ToggleIP(str, allowed)
 }
 
+// AllowIPE is AllowIP returning ErrInvalidCIDR for invalid rules
+func AllowIPE(ip string) error {
+	return filter.AllowIPE(ip)
+}
+
+// BlockIPE is BlockIP returning ErrInvalidCIDR for invalid rules
+func BlockIPE(ip string) error {
+	return filter.BlockIPE(ip)
+}
+
+// ToggleIPE is ToggleIP returning ErrInvalidCIDR for invalid rules
+func ToggleIPE(str string, allowed bool) error {
+	return filter.ToggleIPE(str, allowed)
+}
+
 func AllowCountry(code string) {
 	filter.AllowCountry(code)
 }
@@ -280,6 +900,26 @@ func ToggleCountry(code string, allowed bool) {
 	filter.ToggleCountry(code, allowed)
 }
 
+// AllowCountryE is AllowCountry returning ErrUnknownCountryCode
+func AllowCountryE(code string) error {
+	return filter.AllowCountryE(code)
+}
+
+// BlockCountryE is BlockCountry returning ErrUnknownCountryCode
+func BlockCountryE(code string) error {
+	return filter.BlockCountryE(code)
+}
+
+// ToggleCountryE is ToggleCountry returning ErrUnknownCountryCode
+func ToggleCountryE(code string, allowed bool) error {
+	return filter.ToggleCountryE(code, allowed)
+}
+
+// LimitCountry allows a country but rate limits each of its IPs
+func LimitCountry(code string, perMinute int) {
+	filter.LimitCountry(code, perMinute)
+}
+
 // ToggleDefault alters the default setting
 func ToggleDefault(allowed bool) {
 	filter.ToggleDefault(allowed)
@@ -305,6 +945,11 @@ func NetBlocked(ip net.IP) bool {
 	return filter.NetBlocked(ip)
 }
 
+// Explain returns the evaluation trace for a given IP
+func Explain(ip string) Explanation {
+	return filter.Explain(ip)
+}
+
 func IPToCountry(ip string) string {
 	return filter.IPToCountry(ip)
 }
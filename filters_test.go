@@ -0,0 +1,269 @@
+package ip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/ip/ctx/ctxtest"
+	"github.com/oarkflow/ip/geoip"
+)
+
+// rule is the action of an optional subnet or country rule in the
+// precedence tests
+type rule int
+
+const (
+	none rule = iota
+	allow
+	block
+)
+
+func (r rule) String() string {
+	return [...]string{"none", "allow", "block"}[r]
+}
+
+const (
+	testIP      = "8.8.8.8"
+	testSubnet  = "8.8.8.0/24"
+	testCountry = "US"
+)
+
+// precedenceFilter builds a filter with the given subnet and country
+// rules covering testIP
+func precedenceFilter(t *testing.T, cfg Config, subnet, country rule) *Filter {
+	t.Helper()
+	if code := geoip.Country(testIP); code != testCountry {
+		t.Fatalf("country of %s is %q, want %q", testIP, code, testCountry)
+	}
+	f := newFilter(cfg)
+	t.Cleanup(f.Close)
+	if subnet != none {
+		if err := f.ToggleIPE(testSubnet, subnet == allow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if country != none {
+		f.ToggleCountry(testCountry, country == allow)
+	}
+	return f
+}
+
+func checkDecision(t *testing.T, f *Filter, wantAllowed bool, wantDecidedBy string) {
+	t.Helper()
+	e := f.Explain(testIP)
+	if e.Allowed != wantAllowed || e.DecidedBy != wantDecidedBy {
+		t.Errorf("got allowed %v by %q, want %v by %q", e.Allowed, e.DecidedBy, wantAllowed, wantDecidedBy)
+	}
+	if allowed := f.NetAllowed(net.ParseIP(testIP)); allowed != e.Allowed {
+		t.Errorf("NetAllowed %v disagrees with Explain", allowed)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	const (
+		bySubnetAllow = "subnet allow rule"
+		bySubnetBlock = "subnet block rule"
+		byCountry     = "country rule"
+		byDefault     = "default"
+	)
+	tests := []struct {
+		precedence Precedence
+		subnet     rule
+		country    rule
+		allowed    bool
+		decidedBy  string
+	}{
+		{PrecedenceIPSubnetCountry, none, none, true, byDefault},
+		{PrecedenceIPSubnetCountry, none, allow, true, byCountry},
+		{PrecedenceIPSubnetCountry, none, block, false, byCountry},
+		{PrecedenceIPSubnetCountry, allow, none, true, bySubnetAllow},
+		{PrecedenceIPSubnetCountry, allow, allow, true, bySubnetAllow},
+		{PrecedenceIPSubnetCountry, allow, block, true, bySubnetAllow},
+		{PrecedenceIPSubnetCountry, block, none, false, bySubnetBlock},
+		{PrecedenceIPSubnetCountry, block, allow, false, bySubnetBlock},
+		{PrecedenceIPSubnetCountry, block, block, false, bySubnetBlock},
+
+		{PrecedenceIPCountrySubnet, none, none, true, byDefault},
+		{PrecedenceIPCountrySubnet, none, allow, true, byCountry},
+		{PrecedenceIPCountrySubnet, none, block, false, byCountry},
+		{PrecedenceIPCountrySubnet, allow, none, true, bySubnetAllow},
+		{PrecedenceIPCountrySubnet, allow, allow, true, byCountry},
+		{PrecedenceIPCountrySubnet, allow, block, false, byCountry},
+		{PrecedenceIPCountrySubnet, block, none, false, bySubnetBlock},
+		{PrecedenceIPCountrySubnet, block, allow, true, byCountry},
+		{PrecedenceIPCountrySubnet, block, block, false, byCountry},
+
+		{PrecedenceAllowWins, none, none, true, byDefault},
+		{PrecedenceAllowWins, none, allow, true, byCountry},
+		{PrecedenceAllowWins, none, block, false, byCountry},
+		{PrecedenceAllowWins, allow, none, true, bySubnetAllow},
+		{PrecedenceAllowWins, allow, allow, true, bySubnetAllow},
+		{PrecedenceAllowWins, allow, block, true, bySubnetAllow},
+		{PrecedenceAllowWins, block, none, false, bySubnetBlock},
+		{PrecedenceAllowWins, block, allow, true, byCountry},
+		{PrecedenceAllowWins, block, block, false, bySubnetBlock},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/subnet-%v/country-%v", tt.precedence, tt.subnet, tt.country), func(t *testing.T) {
+			f := precedenceFilter(t, Config{Precedence: tt.precedence}, tt.subnet, tt.country)
+			checkDecision(t, f, tt.allowed, tt.decidedBy)
+		})
+	}
+}
+
+func TestPrecedenceFailMode(t *testing.T) {
+	const (
+		bySubnetAllow = "subnet allow rule"
+		bySubnetBlock = "subnet block rule"
+		byCountry     = "country rule"
+		byFailMode    = "geo database unavailable"
+		byDefault     = "default"
+	)
+	tests := []struct {
+		failMode       FailMode
+		precedence     Precedence
+		blockByDefault bool
+		subnet         rule
+		allowed        bool
+		decidedBy      string
+	}{
+		// the embedded database still applies the blocked country
+		{FailModeEmbedded, PrecedenceIPSubnetCountry, false, none, false, byCountry},
+		{FailModeAllow, PrecedenceIPSubnetCountry, false, none, true, byFailMode},
+		{FailModeDeny, PrecedenceIPSubnetCountry, false, none, false, byFailMode},
+		{FailModeCountrySkip, PrecedenceIPSubnetCountry, false, none, true, byDefault},
+		{FailModeCountrySkip, PrecedenceIPSubnetCountry, true, none, false, byDefault},
+
+		// subnets decide first, FailMode isn't reached
+		{FailModeDeny, PrecedenceIPSubnetCountry, false, allow, true, bySubnetAllow},
+		{FailModeAllow, PrecedenceIPSubnetCountry, false, block, false, bySubnetBlock},
+
+		// FailMode takes the place of the country rules
+		{FailModeDeny, PrecedenceIPCountrySubnet, false, allow, false, byFailMode},
+		{FailModeAllow, PrecedenceIPCountrySubnet, false, block, true, byFailMode},
+		{FailModeCountrySkip, PrecedenceIPCountrySubnet, false, block, false, bySubnetBlock},
+
+		{FailModeDeny, PrecedenceAllowWins, false, allow, true, bySubnetAllow},
+		{FailModeAllow, PrecedenceAllowWins, false, block, true, byFailMode},
+		{FailModeDeny, PrecedenceAllowWins, false, block, false, bySubnetBlock},
+		{FailModeCountrySkip, PrecedenceAllowWins, false, block, false, bySubnetBlock},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%q/%d/default-block-%v/subnet-%v", tt.failMode, tt.precedence, tt.blockByDefault, tt.subnet)
+		t.Run(name, func(t *testing.T) {
+			cfg := Config{
+				FailMode:       tt.failMode,
+				Precedence:     tt.precedence,
+				BlockByDefault: tt.blockByDefault,
+			}
+			f := precedenceFilter(t, cfg, tt.subnet, block)
+			f.dbUnavailable.Store(true)
+			checkDecision(t, f, tt.allowed, tt.decidedBy)
+		})
+	}
+}
+
+func TestCountryRateLimitOnlyForCountryDecisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		limited bool
+	}{
+		{"country rule", Config{}, true},
+		{"single ip rule", Config{AllowedIPs: []string{testIP}}, false},
+		{"subnet rule", Config{AllowedIPs: []string{testSubnet}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.CountryRateLimits = map[string]int{testCountry: 2}
+			cfg.setDefaults()
+			f := newFilter(cfg)
+			t.Cleanup(f.Close)
+			handler := cfg.middleware(func() *Filter { return f })
+			for i := 1; i <= 3; i++ {
+				c := ctxtest.New(testIP)
+				handler(context.Background(), c)
+				if limited := c.Aborted(); limited != (tt.limited && i == 3) {
+					t.Fatalf("request %d limited %v", i, limited)
+				}
+			}
+			wantLimit := 0
+			if tt.limited {
+				wantLimit = 2
+			}
+			if e := f.Explain(testIP); e.RateLimit != wantLimit {
+				t.Errorf("Explain reports limit %d, want %d", e.RateLimit, wantLimit)
+			}
+		})
+	}
+}
+
+func TestLimitCountryRestoresRule(t *testing.T) {
+	for _, before := range []rule{none, allow, block} {
+		t.Run(before.String(), func(t *testing.T) {
+			f := precedenceFilter(t, Config{BlockByDefault: true}, none, before)
+			want := f.Explain(testIP)
+			f.LimitCountry(testCountry, 5)
+			if e := f.Explain(testIP); !e.Allowed || e.RateLimit != 5 {
+				t.Fatalf("limited country: allowed %v, limit %d", e.Allowed, e.RateLimit)
+			}
+			f.LimitCountry(testCountry, 0)
+			if got := f.Explain(testIP); got.Allowed != want.Allowed || got.DecidedBy != want.DecidedBy {
+				t.Errorf("after removing the limit allowed %v by %q, want %v by %q", got.Allowed, got.DecidedBy, want.Allowed, want.DecidedBy)
+			}
+		})
+	}
+}
+
+func TestIPDBDownloadRetries(t *testing.T) {
+	// serve the current database so the download doesn't change it
+	var cache bytes.Buffer
+	if err := geoip.WriteCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = geoip.LoadCacheBytes(cache.Bytes()) })
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first two downloads fail
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(cache.Bytes())
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		IPDBFetchURL:      srv.URL,
+		IPDBRetryInterval: 10 * time.Millisecond,
+		FailMode:          FailModeDeny,
+	}
+	cfg.setDefaults()
+	f := newFilter(cfg)
+	t.Cleanup(f.Close)
+	f.loadIPDB()
+	if !f.dbUnavailable.Load() {
+		t.Fatal("database available before the download")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for f.dbUnavailable.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("database still unavailable after %d downloads", requests.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("%d downloads, want 3", got)
+	}
+	if e := f.Explain(testIP); !e.Allowed || e.DecidedBy != "default" {
+		t.Errorf("after recovering allowed %v by %q, want allowed by default", e.Allowed, e.DecidedBy)
+	}
+}
@@ -0,0 +1,66 @@
+package ip
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/oarkflow/ip/ctx"
+)
+
+// GeoHeaderNames are the request headers set for upstream services,
+// empty names are skipped. The geo database only holds countries, so
+// there are no city or ASN headers.
+type GeoHeaderNames struct {
+	Country  string
+	ClientIP string
+}
+
+// DefaultGeoHeaderNames only passes the country, as X-Geo-Country.
+var DefaultGeoHeaderNames = GeoHeaderNames{Country: "X-Geo-Country"}
+
+// GeoHeadersKey is the context key GeoHeaders stores the headers under.
+const GeoHeadersKey = "ip_geo_headers"
+
+// SetGeoHeaders sets the geo headers of the client at ip on h, e.g. in
+// the Rewrite of an httputil.ReverseProxy. Values the client sent
+// under the same names are replaced, so upstream services can trust
+// them. Unknown countries are passed as "ZZ".
+func SetGeoHeaders(h http.Header, ip string, names GeoHeaderNames) {
+	setGeoHeaders(h, ClientInfo{IP: ip, Country: Country(ip)}, names)
+}
+
+func setGeoHeaders(h http.Header, info ClientInfo, names GeoHeaderNames) {
+	if names.Country != "" {
+		country := info.Country
+		if country == "" {
+			country = "ZZ"
+		}
+		h.Set(names.Country, country)
+	}
+	if names.ClientIP != "" {
+		h.Set(names.ClientIP, info.IP)
+	}
+}
+
+// GeoHeaders returns a middleware storing the geo headers of the
+// client in the context under GeoHeadersKey, as an http.Header for the
+// proxying handler to copy into the upstream request. It reuses what
+// Detect stored when it ran before. DefaultGeoHeaderNames is used when
+// names is omitted.
+func GeoHeaders(names ...GeoHeaderNames) HandlerFunc {
+	headerNames := DefaultGeoHeaderNames
+	if len(names) > 0 {
+		headerNames = names[0]
+	}
+	return func(cx context.Context, c ctx.Context) {
+		info, ok := FromContext(c)
+		if !ok {
+			info.IP = FromRequest(c)
+			info.Country = Country(info.IP)
+		}
+		h := http.Header{}
+		setGeoHeaders(h, info, headerNames)
+		c.Set(GeoHeadersKey, h)
+		c.Next(cx)
+	}
+}
@@ -0,0 +1,122 @@
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// ErrAnomalousDatabase is returned when a load is refused by the
+// AnomalyCheck.
+var ErrAnomalousDatabase = errors.New("geoip: database refused as anomalous")
+
+// AnomalyCheck compares a newly parsed database against the loaded one
+// before swapping it in, protecting against e.g. truncated downloads
+// silently wiping most of the data. Each address family is compared
+// on its own, and only when the new database replaces it.
+type AnomalyCheck struct {
+	// MaxShrink is the largest accepted drop of the range count, 0.5
+	// refuses a database with less than half the ranges. Zero disables.
+	MaxShrink float64
+	// MaxShift is the largest accepted change of the country
+	// distribution of ranges, as the total variation distance between
+	// 0 (identical) and 1 (disjoint). Zero disables.
+	MaxShift float64
+	// OnAnomaly, when set, is called for every refused database
+	OnAnomaly func(Anomaly)
+}
+
+// Anomaly describes a refused database.
+type Anomaly struct {
+	Family    string  `json:"family"`
+	OldRanges int     `json:"old_ranges"`
+	NewRanges int     `json:"new_ranges"`
+	Shift     float64 `json:"shift"`
+	Reason    string  `json:"reason"`
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s: %s (%d -> %d ranges, shift %.2f)", a.Family, a.Reason, a.OldRanges, a.NewRanges, a.Shift)
+}
+
+var anomalyCheck atomic.Pointer[AnomalyCheck]
+
+// SetAnomalyCheck enables checking loads against c, nil disables it,
+// which is the default.
+func SetAnomalyCheck(c *AnomalyCheck) {
+	anomalyCheck.Store(c)
+}
+
+// checkAnomalies returns an ErrAnomalousDatabase error if db deviates
+// from old more than the AnomalyCheck accepts
+func checkAnomalies(old, db *database) error {
+	c := anomalyCheck.Load()
+	if c == nil {
+		return nil
+	}
+	var anomalies []Anomaly
+	if len(db.ip4) > 0 {
+		anomalies = c.compare("ipv4", old.ip4txt, db.ip4txt, anomalies)
+	}
+	if len(db.ip6) > 0 {
+		anomalies = c.compare("ipv6", old.ip6txt, db.ip6txt, anomalies)
+	}
+	if len(anomalies) == 0 {
+		return nil
+	}
+	if c.OnAnomaly != nil {
+		for _, a := range anomalies {
+			c.OnAnomaly(a)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrAnomalousDatabase, anomalies[0])
+}
+
+func (c *AnomalyCheck) compare(family string, oldTxt, newTxt []byte, anomalies []Anomaly) []Anomaly {
+	a := Anomaly{
+		Family:    family,
+		OldRanges: len(oldTxt) / 2,
+		NewRanges: len(newTxt) / 2,
+	}
+	// an almost empty old table, e.g. with IPLOC_IPV4ONLY, can't be compared
+	if a.OldRanges <= 1 {
+		return anomalies
+	}
+	a.Shift = distributionShift(oldTxt, newTxt)
+	switch {
+	case c.MaxShrink > 0 && float64(a.NewRanges) < float64(a.OldRanges)*(1-c.MaxShrink):
+		a.Reason = "range count dropped"
+	case c.MaxShift > 0 && a.Shift > c.MaxShift:
+		a.Reason = "country distribution shifted"
+	default:
+		return anomalies
+	}
+	return append(anomalies, a)
+}
+
+// distributionShift is the total variation distance between the
+// share of ranges per country of two code tables
+func distributionShift(oldTxt, newTxt []byte) float64 {
+	share := func(txt []byte) map[string]float64 {
+		counts := map[string]float64{}
+		for i := 0; i+1 < len(txt); i += 2 {
+			counts[string(txt[i:i+2])]++
+		}
+		for code := range counts {
+			counts[code] /= float64(len(txt) / 2)
+		}
+		return counts
+	}
+	oldShare, newShare := share(oldTxt), share(newTxt)
+	shift := 0.0
+	for code, p := range oldShare {
+		shift += math.Abs(p - newShare[code])
+	}
+	for code, p := range newShare {
+		if _, ok := oldShare[code]; !ok {
+			shift += p
+		}
+	}
+	return shift / 2
+}
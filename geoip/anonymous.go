@@ -0,0 +1,77 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// AnonymousIP holds the anonymizer flags of an address.
+type AnonymousIP struct {
+	IsAnonymous        bool `json:"is_anonymous"`
+	IsAnonymousVPN     bool `json:"is_anonymous_vpn"`
+	IsHostingProvider  bool `json:"is_hosting_provider"`
+	IsPublicProxy      bool `json:"is_public_proxy"`
+	IsResidentialProxy bool `json:"is_residential_proxy"`
+	IsTorExitNode      bool `json:"is_tor_exit_node"`
+}
+
+// AnonymousIPProvider looks up the anonymizer flags of an address, ok
+// is false for addresses the provider knows nothing about. It is
+// implemented by AnonymousIPDB, other sources can be plugged in the
+// same way.
+type AnonymousIPProvider interface {
+	AnonymousIP(ip net.IP) (info AnonymousIP, ok bool)
+}
+
+// AnonymousIPDB is a loaded MaxMind GeoIP2 Anonymous IP database. It
+// is read only and safe for concurrent use.
+type AnonymousIPDB struct {
+	db *mmdb
+}
+
+// LoadAnonymousIP parses a GeoIP2 Anonymous IP database from b, which
+// must not be modified afterwards.
+func LoadAnonymousIP(b []byte) (*AnonymousIPDB, error) {
+	db, err := parseMMDB(b)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(db.dbType, "Anonymous-IP") {
+		return nil, fmt.Errorf("geoip: %q is not an Anonymous IP database", db.dbType)
+	}
+	return &AnonymousIPDB{db: db}, nil
+}
+
+// OpenAnonymousIP reads a GeoIP2 Anonymous IP database (.mmdb) file.
+func OpenAnonymousIP(path string) (*AnonymousIPDB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadAnonymousIP(b)
+}
+
+func (a *AnonymousIPDB) AnonymousIP(ip net.IP) (AnonymousIP, bool) {
+	value, ok := a.db.lookup(ip)
+	if !ok {
+		return AnonymousIP{}, false
+	}
+	record, ok := value.(map[string]any)
+	if !ok {
+		return AnonymousIP{}, false
+	}
+	flag := func(key string) bool {
+		b, _ := record[key].(bool)
+		return b
+	}
+	return AnonymousIP{
+		IsAnonymous:        flag("is_anonymous"),
+		IsAnonymousVPN:     flag("is_anonymous_vpn"),
+		IsHostingProvider:  flag("is_hosting_provider"),
+		IsPublicProxy:      flag("is_public_proxy"),
+		IsResidentialProxy: flag("is_residential_proxy"),
+		IsTorExitNode:      flag("is_tor_exit_node"),
+	}, true
+}
@@ -0,0 +1,57 @@
+package geoip
+
+// Attribution is the notice and license a geo database requires to be
+// displayed by products using it.
+type Attribution struct {
+	Name       string `json:"name"`
+	Notice     string `json:"notice"`
+	URL        string `json:"url"`
+	License    string `json:"license"`
+	LicenseURL string `json:"license_url"`
+}
+
+var (
+	// IP2LocationLite is the attribution of the embedded database and
+	// to pass to LoadDBIPReader for CSV files from IP2Location LITE.
+	IP2LocationLite = Attribution{
+		Name:       "IP2Location LITE",
+		Notice:     "This site or product includes IP2Location LITE data available from https://lite.ip2location.com.",
+		URL:        "https://lite.ip2location.com",
+		License:    "CC BY-SA 4.0",
+		LicenseURL: "https://creativecommons.org/licenses/by-sa/4.0/",
+	}
+	// DBIPLite is the attribution to pass to LoadDBIPReader for the
+	// DB-IP lite CSV files.
+	DBIPLite = Attribution{
+		Name:       "DB-IP Lite",
+		Notice:     "IP Geolocation by DB-IP (https://db-ip.com).",
+		URL:        "https://db-ip.com",
+		License:    "CC BY 4.0",
+		LicenseURL: "https://creativecommons.org/licenses/by/4.0/",
+	}
+)
+
+// Attributions returns the attributions of the loaded databases, one
+// per distinct source.
+func Attributions() []Attribution {
+	db := current.Load()
+	return append([]Attribution(nil), db.attributions...)
+}
+
+// mergeAttributions returns the distinct attributions of a and b
+func mergeAttributions(a, b []Attribution) []Attribution {
+	merged := append([]Attribution(nil), a...)
+	for _, attr := range b {
+		found := false
+		for _, m := range merged {
+			if m == attr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, attr)
+		}
+	}
+	return merged
+}
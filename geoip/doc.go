@@ -0,0 +1,11 @@
+// Package geoip resolves IP addresses to ISO 3166-1 alpha-2 country
+// codes using an embedded IP2Location LITE database, which can be
+// replaced at runtime with LoadDBIPReader or LoadCacheBytes.
+//
+// Lookups are lock-free and safe for concurrent use with loading: a
+// new database is parsed and its lookup tables are built aside, then
+// it is published with a single atomic pointer swap. A lookup sees
+// either the old or the new database, never a mix of both, and never
+// waits for a load. Concurrent loads of different address families,
+// e.g. an IPv4 and an IPv6 file, both end up in the database.
+package geoip
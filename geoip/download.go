@@ -0,0 +1,184 @@
+package geoip
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultDownloadTimeout bounds Download when DownloadConfig.Timeout
+// is zero.
+const DefaultDownloadTimeout = 2 * time.Minute
+
+// DownloadConfig configures how Download fetches a database.
+type DownloadConfig struct {
+	// Client is used as is when set, ignoring ProxyURL
+	Client *http.Client
+	// Header is sent with the request, e.g. for token authentication
+	Header http.Header
+	// URL of a CSV, optionally gzip or zip compressed, or of a cache
+	// written by WriteCache
+	URL       string
+	UserAgent string
+	// ProxyURL overrides the proxy from the environment
+	ProxyURL string
+	// Username and Password enable basic auth when Username is set
+	Username string
+	Password string
+	Timeout  time.Duration
+	// Attributions of the downloaded source, see LoadDBIPReader. A
+	// cache written by WriteCache carries its own.
+	Attributions []Attribution
+	// CachePath, when set, keeps the last download as a cache written
+	// by WriteCache. A cache younger than MaxAge is loaded instead of
+	// downloading, an older one only when the download fails.
+	CachePath string
+	MaxAge    time.Duration
+	// Clock and FS default to SystemClock and OSFS
+	Clock Clock
+	FS    FS
+}
+
+// Download fetches the database at cfg.URL and loads it, replacing the
+// current one only when the download and parsing succeed. With a
+// CachePath, a fresh cache skips the download and a stale one is
+// loaded if the download fails, the download error is still returned.
+func Download(ctx context.Context, cfg DownloadConfig) error {
+	if cfg.URL == "" {
+		return fmt.Errorf("geoip: download URL is empty")
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	if cfg.FS == nil {
+		cfg.FS = OSFS
+	}
+	if cfg.CachePath == "" {
+		return download(ctx, cfg)
+	}
+	info, statErr := cfg.FS.Stat(cfg.CachePath)
+	if statErr == nil && cfg.Clock.Now().Sub(info.ModTime()) < cfg.MaxAge {
+		if err := loadCacheFile(cfg.FS, cfg.CachePath); err == nil {
+			return nil
+		}
+	}
+	err := download(ctx, cfg)
+	if err != nil {
+		if statErr == nil && loadCacheFile(cfg.FS, cfg.CachePath) == nil {
+			return fmt.Errorf("%w (loaded stale cache)", err)
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	if err := WriteCache(&buf); err != nil {
+		return err
+	}
+	return cfg.FS.WriteFile(cfg.CachePath, buf.Bytes(), 0o644)
+}
+
+func loadCacheFile(fsys FS, name string) error {
+	b, err := fsys.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return LoadCacheBytes(b)
+}
+
+func download(ctx context.Context, cfg DownloadConfig) (err error) {
+	defer func(start time.Time) { observeDownload(start, err) }(time.Now())
+	client, err := cfg.client()
+	if err != nil {
+		return err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDownloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range cfg.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geoip: downloading %s: %s", cfg.URL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return loadArchive(body, cfg.Attributions)
+}
+
+func (cfg DownloadConfig) client() (*http.Client, error) {
+	if cfg.Client != nil {
+		return cfg.Client, nil
+	}
+	if cfg.ProxyURL == "" {
+		return http.DefaultClient, nil
+	}
+	proxy, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: invalid proxy URL: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	return &http.Client{Transport: transport}, nil
+}
+
+// loadArchive loads a cache, or a CSV which may be gzip compressed or
+// the first .csv file of a zip archive
+func loadArchive(b []byte, attributions []Attribution) error {
+	switch {
+	case bytes.HasPrefix(b, []byte(cacheMagic)):
+		return LoadCacheBytes(b)
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return LoadDBIPReader(r, attributions...)
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return err
+		}
+		for _, file := range zr.File {
+			if !strings.HasSuffix(strings.ToLower(file.Name), ".csv") {
+				continue
+			}
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return LoadDBIPReader(r, attributions...)
+		}
+		return fmt.Errorf("geoip: no .csv file in zip archive")
+	}
+	return LoadDBIPReader(bytes.NewReader(b), attributions...)
+}
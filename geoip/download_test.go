@@ -0,0 +1,124 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// memFS keeps files in memory, stamped with the time of a fakeClock
+type memFS struct {
+	clock *fakeClock
+	files map[string]memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (f memFile) Name() string       { return "cache" }
+func (f memFile) Size() int64        { return int64(len(f.data)) }
+func (f memFile) Mode() fs.FileMode  { return 0o644 }
+func (f memFile) ModTime() time.Time { return f.modTime }
+func (f memFile) IsDir() bool        { return false }
+func (f memFile) Sys() any           { return nil }
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	if file, ok := m.files[name]; ok {
+		return file, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	if file, ok := m.files[name]; ok {
+		return file.data, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (m *memFS) WriteFile(name string, data []byte, _ fs.FileMode) error {
+	m.files[name] = memFile{data: bytes.Clone(data), modTime: m.clock.now}
+	return nil
+}
+
+func TestDownloadCacheExpiry(t *testing.T) {
+	restoreDatabase(t)
+	// the cache maps 1.2.3.4 to AU, the download to JP
+	if err := LoadDBIPReader(strings.NewReader("1.0.0.0,1.255.255.255,AU\n")); err != nil {
+		t.Fatal(err)
+	}
+	var cache bytes.Buffer
+	if err := WriteCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	var downloads atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("1.0.0.0,1.255.255.255,JP\n"))
+	}))
+	defer srv.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	fsys := &memFS{clock: clock, files: map[string]memFile{
+		"geo.cache": {data: cache.Bytes(), modTime: start},
+	}}
+	cfg := DownloadConfig{
+		URL:       srv.URL,
+		CachePath: "geo.cache",
+		MaxAge:    time.Hour,
+		Clock:     clock,
+		FS:        fsys,
+	}
+	check := func(step string, wantErr bool, wantDownloads int32, wantCountry string) {
+		t.Helper()
+		err := Download(context.Background(), cfg)
+		if (err != nil) != wantErr {
+			t.Fatalf("%s: error %v, want error %v", step, err, wantErr)
+		}
+		if got := downloads.Load(); got != wantDownloads {
+			t.Fatalf("%s: %d downloads, want %d", step, got, wantDownloads)
+		}
+		if got := Country("1.2.3.4"); got != wantCountry {
+			t.Fatalf("%s: country %q, want %q", step, got, wantCountry)
+		}
+	}
+
+	clock.now = start.Add(59 * time.Minute)
+	check("fresh cache", false, 0, "AU")
+
+	clock.now = start.Add(2 * time.Hour)
+	failing.Store(true)
+	check("stale cache, failed download", true, 1, "AU")
+
+	failing.Store(false)
+	check("stale cache", false, 2, "JP")
+	if got := fsys.files["geo.cache"].modTime; !got.Equal(clock.now) {
+		t.Fatalf("cache written at %v, want %v", got, clock.now)
+	}
+
+	// the rewritten cache is fresh again
+	clock.now = clock.now.Add(30 * time.Minute)
+	check("rewritten cache", false, 2, "JP")
+}
@@ -0,0 +1,130 @@
+package geoip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+)
+
+// ExportFormat selects the output of Export.
+type ExportFormat string
+
+const (
+	// ExportCSV writes "start,end,country" lines, readable by
+	// LoadDBIPReader, after "# attribution: {...}" lines carrying the
+	// attributions of the database
+	ExportCSV ExportFormat = "csv"
+	// ExportJSON writes an array of {"start","end","country"} objects
+	ExportJSON ExportFormat = "json"
+)
+
+// Range is a contiguous address range of one country.
+type Range struct {
+	Start   netip.Addr `json:"start"`
+	End     netip.Addr `json:"end"`
+	Country string     `json:"country"`
+}
+
+// Export streams the ranges of the loaded database to w, IPv4 first.
+// Ranges without a country ("ZZ") are left out, as LoadDBIPReader
+// fills in gaps with "ZZ" the output loads back to the same database,
+// attributions included. JSON output holds the ranges only, see
+// Attributions.
+func Export(w io.Writer, format ExportFormat) error {
+	if format != ExportCSV && format != ExportJSON {
+		return fmt.Errorf("geoip: unknown export format %q", format)
+	}
+	db := current.Load()
+	bw := bufio.NewWriter(w)
+	first := true
+	if format == ExportJSON {
+		bw.WriteByte('[')
+	} else {
+		for _, a := range db.attributions {
+			b, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "%s%s\n", attributionComment, b)
+		}
+	}
+	err := db.ranges(func(r Range) error {
+		if format == ExportCSV {
+			_, err := fmt.Fprintf(bw, "%s,%s,%s\n", r.Start, r.End, r.Country)
+			return err
+		}
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if format == ExportJSON {
+		bw.WriteString("]\n")
+	}
+	return bw.Flush()
+}
+
+// Ranges calls fn for every range with a country in the loaded
+// database, stopping at the first error.
+func Ranges(fn func(Range) error) error {
+	return current.Load().ranges(fn)
+}
+
+func (db *database) ranges(fn func(Range) error) error {
+	for i, start := range db.ip4 {
+		code := string(db.ip4txt[i*2 : i*2+2])
+		if code == "ZZ" {
+			continue
+		}
+		end := uint32(math.MaxUint32)
+		if i+1 < len(db.ip4) {
+			end = db.ip4[i+1] - 1
+		}
+		if err := fn(Range{Start: addr4(start), End: addr4(end), Country: code}); err != nil {
+			return err
+		}
+	}
+	for i := 0; i+1 < len(db.ip6); i += 2 {
+		code := string(db.ip6txt[i : i+2])
+		if code == "ZZ" {
+			continue
+		}
+		end := netip.AddrFrom16([16]byte{
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		})
+		if i+3 < len(db.ip6) {
+			end = addr6(db.ip6[i+2], db.ip6[i+3]).Prev()
+		}
+		if err := fn(Range{Start: addr6(db.ip6[i], db.ip6[i+1]), End: end, Country: code}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addr4(n uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+func addr6(high, low uint64) netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], high)
+	binary.BigEndian.PutUint64(b[8:], low)
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,30 @@
+package geoip
+
+import (
+	"net"
+)
+
+// fallbackMasks are the IPv6 aggregations tried by CountryByIPFallback,
+// a /48 is the usual end-site assignment and a /32 the usual minimum
+// registry allocation to an ISP.
+var fallbackMasks = []net.IPMask{
+	net.CIDRMask(48, 128),
+	net.CIDRMask(32, 128),
+}
+
+// CountryByIPFallback is CountryByIP but, for IPv6 addresses without a
+// country, it retries with the start of the enclosing /48 and /32
+// before giving up, which improves coverage of mobile networks where
+// only part of an allocation is listed.
+func CountryByIPFallback(ip net.IP) string {
+	code := countryByIP(ip)
+	if ip == nil || ip.To4() != nil || (len(code) > 0 && string(code) != "ZZ") {
+		return string(code)
+	}
+	for _, mask := range fallbackMasks {
+		if c := countryByIP(ip.Mask(mask)); len(c) > 0 && string(c) != "ZZ" {
+			return string(c)
+		}
+	}
+	return string(code)
+}
@@ -63,8 +63,21 @@ func isPrivateAddress(address string) (bool, error) {
 	return false, nil
 }
 
-// FromRequest determine user ip
+// FromRequest determine user ip, see UseProvider to read it the way
+// a specific load balancer or CDN passes it
 func FromRequest(c ctx.Context) string {
+	return FromRequestWith(provider.Load(), c)
+}
+
+// FromRequestWith is FromRequest reading the client IP the way p, from
+// NewProvider, passes it. A nil p tries the common proxy headers in turn.
+func FromRequestWith(p *Provider, c ctx.Context) string {
+	if p != nil {
+		if ip := p.fromProvider(c); ip != "" {
+			return ip
+		}
+		return c.ClientIP()
+	}
 	var headerValue []byte
 	for _, headerName := range possibleHeaders {
 		headerValue = c.GetHeader(headerName)
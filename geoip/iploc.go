@@ -7,7 +7,9 @@ import (
 	"io"
 	"net"
 	"os"
-	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/oarkflow/ip/geoip/data"
@@ -16,31 +18,49 @@ import (
 // Version is iplocation database version.
 const Version = "v1.0.20211029"
 
-var (
-	ip4uint []uint32
-	ip6uint []uint64
-)
+// database holds the sorted range start addresses of each family,
+// with the country code of range i at txt[i*2:i*2+2]. A database is
+// prepared before it is published and never modified afterwards,
+// loading swaps in a new one.
+type database struct {
+	ip4       []uint32
+	ip4txt    []byte
+	ip6       []uint64 // high, low pairs
+	ip6txt    []byte
+	countries map[string]bool
+	known4    prefixSet
+	known6    prefixSet
+	// attributions of the sources the ranges were loaded from
+	attributions []Attribution
+	// version of the source, loadedAt is zero for the embedded one
+	version  string
+	loadedAt time.Time
+}
+
+// current is swapped, never modified, by loads
+var current atomic.Pointer[database]
 
 func init() {
-	// ipv4
-	ip4uint = *(*[]uint32)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&data.Ip4bin[0])),
-		Len:  len(data.Ip4bin) / 4,
-		Cap:  len(data.Ip4bin) / 4,
-	}))
+	db := &database{
+		// ipv4
+		ip4:    unsafe.Slice((*uint32)(unsafe.Pointer(&data.Ip4bin[0])), len(data.Ip4bin)/4),
+		ip4txt: data.Ip4txt,
+		ip6:    []uint64{0, 0},
+		ip6txt: []byte("ZZ"),
+
+		attributions: []Attribution{IP2LocationLite},
+		version:      Version,
+	}
 
 	// ipv6
 	if os.Getenv("IPLOC_IPV4ONLY") == "" {
 		r, _ := gzip.NewReader(bytes.NewReader(data.Ip6bin))
 		data.Ip6bin, _ = io.ReadAll(r)
-		ip6uint = *(*[]uint64)(unsafe.Pointer(&reflect.SliceHeader{
-			Data: uintptr(unsafe.Pointer(&data.Ip6bin[0])),
-			Len:  len(data.Ip6bin) / 8,
-			Cap:  len(data.Ip6bin) / 8,
-		}))
-	} else {
-		ip6uint = []uint64{0, 0}
+		db.ip6 = unsafe.Slice((*uint64)(unsafe.Pointer(&data.Ip6bin[0])), len(data.Ip6bin)/8)
+		db.ip6txt = data.Ip6txt
 	}
+	db.prepare()
+	current.Store(db)
 }
 
 // Country return ISO 3166-1 alpha-2 country code of IP.
@@ -48,10 +68,16 @@ func countryByIP(ip net.IP) []byte {
 	if ip == nil {
 		return nil
 	}
+	db := current.Load()
+	ip4uint, ip6uint := db.ip4, db.ip6
 
 	if ip4 := ip.To4(); ip4 != nil {
 		// ipv4
+		countLookup("ipv4")
 		n := binary.BigEndian.Uint32(ip4)
+		if !db.known4.has(uint16(n >> 16)) {
+			return unknown
+		}
 		i, j := 0, len(ip4uint)
 		_ = ip4uint[j-1]
 		for i < j {
@@ -62,10 +88,17 @@ func countryByIP(ip net.IP) []byte {
 				i = h + 1
 			}
 		}
-		return data.Ip4txt[i*2-2 : i*2]
+		return db.ip4txt[i*2-2 : i*2]
 	}
-	// ipv6
+	// ipv6, addresses synthesized by NAT64 resolve their ipv4
+	if ip4 := nat64Embedded(ip); ip4 != nil {
+		return countryByIP(ip4)
+	}
+	countLookup("ipv6")
 	high := binary.BigEndian.Uint64(ip)
+	if !db.known6.has(uint16(high >> 48)) {
+		return unknown
+	}
 	low := binary.BigEndian.Uint64(ip[8:])
 	i, j := 0, len(ip6uint)
 	_ = ip6uint[j-1]
@@ -78,7 +111,7 @@ func countryByIP(ip net.IP) []byte {
 			i = h + 2
 		}
 	}
-	return data.Ip6txt[i-2 : i]
+	return db.ip6txt[i-2 : i]
 }
 
 func Country(ip string) string {
@@ -132,3 +165,56 @@ func IsReservedIPv4(ip net.IP) bool {
 	}
 	return false
 }
+
+// prepare builds the lookup tables derived from the ranges, it must
+// run before db is published
+func (db *database) prepare() {
+	db.loadCountries()
+	db.loadKnown()
+}
+
+func (db *database) loadCountries() {
+	db.countries = map[string]bool{}
+	for _, txt := range [][]byte{db.ip4txt, db.ip6txt} {
+		for i := 0; i+1 < len(txt); i += 2 {
+			db.countries[string(txt[i:i+2])] = true
+		}
+	}
+	// ZZ marks unassigned ranges
+	delete(db.countries, "ZZ")
+}
+
+// Countries returns the sorted ISO 3166-1 alpha-2 codes present in the database.
+func Countries() []string {
+	db := current.Load()
+	codes := make([]string, 0, len(db.countries))
+	for code := range db.countries {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// KnownCountry reports whether code is present in the database.
+func KnownCountry(code string) bool {
+	return current.Load().countries[code]
+}
+
+// DatabaseVersion returns the version of the loaded database: Version
+// for the embedded one, the version stored by WriteCache for a cache,
+// or "loaded-" and the load time in UTC for other sources.
+func DatabaseVersion() string {
+	return current.Load().version
+}
+
+// DatabaseLoadedAt returns when the database was loaded, or the zero
+// time while the embedded one is in use.
+func DatabaseLoadedAt() time.Time {
+	return current.Load().loadedAt
+}
+
+// IPv6Enabled reports whether the database holds IPv6 ranges, it
+// doesn't when built with IPLOC_IPV4ONLY set.
+func IPv6Enabled() bool {
+	return len(current.Load().ip6) > 2
+}
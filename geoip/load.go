@@ -0,0 +1,308 @@
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// cacheMagic prefixes databases written by WriteCache.
+const cacheMagic = "IPLOC1"
+
+// cacheMeta follows the attributions of a cache
+type cacheMeta struct {
+	Version string `json:"version,omitempty"`
+}
+
+var (
+	// ErrEmptyDatabase is returned when a source contains no ranges.
+	ErrEmptyDatabase = errors.New("geoip: database contains no ranges")
+	// ErrInvalidCache is returned by LoadCacheBytes for malformed input.
+	ErrInvalidCache = errors.New("geoip: invalid database cache")
+)
+
+// LoadDBIPReader replaces the database with country ranges read from a
+// CSV stream in the DB-IP lite layout (start, end, country, ...). Start
+// and end are either textual IPs or, as in the IP2Location LITE files,
+// decimal integers. Ranges not covered by the stream resolve to "ZZ".
+// An address family without any row keeps its current data, so IPv4
+// and IPv6 can be loaded from separate files.
+//
+// attributions are the notices the source requires, e.g. DBIPLite or
+// IP2LocationLite. Without any, the "# attribution:" lines written by
+// Export are used, the source is never guessed.
+func LoadDBIPReader(r io.Reader, attributions ...Attribution) (err error) {
+	defer func() { countLoad(err) }()
+	db, err := parseCSV(r)
+	if err != nil {
+		return err
+	}
+	if len(attributions) > 0 {
+		db.attributions = attributions
+	}
+	return swap(db)
+}
+
+// LoadCacheBytes replaces the database with one serialized by
+// WriteCache, e.g. embedded with go:embed. The attributions of the
+// serialized database are restored along with it.
+func LoadCacheBytes(b []byte) (err error) {
+	defer func() { countLoad(err) }()
+	db, err := parseCache(b)
+	if err != nil {
+		return err
+	}
+	return swap(db)
+}
+
+// WriteCache serializes the loaded database in the format read by
+// LoadCacheBytes.
+func WriteCache(w io.Writer) error {
+	db := current.Load()
+	var buf bytes.Buffer
+	buf.WriteString(cacheMagic)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(db.ip4)))
+	_ = binary.Write(&buf, binary.BigEndian, db.ip4)
+	buf.Write(db.ip4txt)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(db.ip6)/2))
+	_ = binary.Write(&buf, binary.BigEndian, db.ip6)
+	buf.Write(db.ip6txt)
+	// trailing attributions and metadata, optional when reading
+	enc := json.NewEncoder(&buf)
+	_ = enc.Encode(db.attributions)
+	_ = enc.Encode(cacheMeta{Version: db.version})
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// swap installs parsed, keeping the current data of families it
+// lacks. Concurrent swaps retry until their merge is based on the
+// database they replace, so none of them loses a family.
+func swap(parsed *database) error {
+	if len(parsed.ip4) == 0 && len(parsed.ip6) == 0 {
+		return ErrEmptyDatabase
+	}
+	for {
+		old := current.Load()
+		if err := checkAnomalies(old, parsed); err != nil {
+			return err
+		}
+		db := &database{
+			ip4:          parsed.ip4,
+			ip4txt:       parsed.ip4txt,
+			ip6:          parsed.ip6,
+			ip6txt:       parsed.ip6txt,
+			attributions: parsed.attributions,
+			version:      parsed.version,
+			loadedAt:     time.Now(),
+		}
+		if db.version == "" {
+			db.version = "loaded-" + db.loadedAt.UTC().Format("20060102T150405Z")
+		}
+		if len(db.ip4) == 0 || len(db.ip6) == 0 {
+			db.attributions = mergeAttributions(db.attributions, old.attributions)
+		}
+		if len(db.ip4) == 0 {
+			db.ip4, db.ip4txt = old.ip4, old.ip4txt
+		}
+		if len(db.ip6) == 0 {
+			db.ip6, db.ip6txt = old.ip6, old.ip6txt
+		}
+		// prepare before publishing so lookups never wait on it
+		db.prepare()
+		if current.CompareAndSwap(old, db) {
+			return nil
+		}
+	}
+}
+
+func parseCache(b []byte) (*database, error) {
+	if !bytes.HasPrefix(b, []byte(cacheMagic)) {
+		return nil, ErrInvalidCache
+	}
+	b = b[len(cacheMagic):]
+	db := &database{}
+	n, b, ok := readCount(b, 4)
+	if !ok {
+		return nil, ErrInvalidCache
+	}
+	db.ip4 = make([]uint32, n)
+	for i := range db.ip4 {
+		db.ip4[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	db.ip4txt, b = bytes.Clone(b[n*4:n*6]), b[n*6:]
+	n, b, ok = readCount(b, 16)
+	if !ok {
+		return nil, ErrInvalidCache
+	}
+	db.ip6 = make([]uint64, n*2)
+	for i := range db.ip6 {
+		db.ip6[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+	db.ip6txt = bytes.Clone(b[n*16 : n*18])
+	dec := json.NewDecoder(bytes.NewReader(b[n*18:]))
+	if err := dec.Decode(&db.attributions); err != nil && err != io.EOF {
+		return nil, ErrInvalidCache
+	}
+	var meta cacheMeta
+	if err := dec.Decode(&meta); err != nil && err != io.EOF {
+		return nil, ErrInvalidCache
+	}
+	db.version = meta.Version
+	if (len(db.ip4) > 0 && db.ip4[0] != 0) || (len(db.ip6) > 0 && db.ip6[0]|db.ip6[1] != 0) {
+		return nil, ErrInvalidCache
+	}
+	return db, nil
+}
+
+// readCount reads a range count and checks b holds that many ranges
+// of size bytes plus their country codes
+func readCount(b []byte, size int) (int, []byte, bool) {
+	if len(b) < 4 {
+		return 0, nil, false
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if len(b) < n*(size+2) {
+		return 0, nil, false
+	}
+	return n, b, true
+}
+
+// attributionComment prefixes the attribution lines of exported CSVs
+const attributionComment = "# attribution: "
+
+func parseCSV(r io.Reader) (*database, error) {
+	db := &database{}
+	// leading attribution comments, other comments are skipped by cr
+	br := bufio.NewReader(r)
+	for {
+		if b, err := br.Peek(1); err != nil || b[0] != '#' {
+			break
+		}
+		line, err := br.ReadString('\n')
+		if text, ok := strings.CutPrefix(strings.TrimSpace(line), strings.TrimSpace(attributionComment)); ok {
+			var a Attribution
+			if json.Unmarshal([]byte(text), &a) == nil {
+				db.attributions = append(db.attributions, a)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	cr := csv.NewReader(br)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	var next4 uint32
+	next6 := netip.IPv6Unspecified()
+	done4, done6 := false, false
+	line := 0
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("geoip: line %d: expected start, end and country", line)
+		}
+		start, end, err := parseRange(record[0], record[1])
+		if err != nil {
+			return nil, fmt.Errorf("geoip: line %d: %w", line, err)
+		}
+		code := strings.ToUpper(strings.TrimSpace(record[2]))
+		if len(code) != 2 {
+			code = "ZZ"
+		}
+		if start.Is4() {
+			if done4 {
+				continue
+			}
+			s := binary.BigEndian.Uint32(start.AsSlice())
+			if s < next4 {
+				return nil, fmt.Errorf("geoip: line %d: ranges must be sorted", line)
+			}
+			if s > next4 {
+				db.ip4 = append(db.ip4, next4)
+				db.ip4txt = append(db.ip4txt, "ZZ"...)
+			}
+			db.ip4 = append(db.ip4, s)
+			db.ip4txt = append(db.ip4txt, code...)
+			next4 = binary.BigEndian.Uint32(end.AsSlice()) + 1
+			done4 = next4 == 0
+			continue
+		}
+		if done6 {
+			continue
+		}
+		if start != next6 {
+			if start.Less(next6) {
+				return nil, fmt.Errorf("geoip: line %d: ranges must be sorted", line)
+			}
+			db.ip6 = appendAddr6(db.ip6, next6)
+			db.ip6txt = append(db.ip6txt, "ZZ"...)
+		}
+		db.ip6 = appendAddr6(db.ip6, start)
+		db.ip6txt = append(db.ip6txt, code...)
+		next6 = end.Next()
+		done6 = !next6.IsValid()
+	}
+	// close the tail of each family
+	if len(db.ip4) > 0 && !done4 {
+		db.ip4 = append(db.ip4, next4)
+		db.ip4txt = append(db.ip4txt, "ZZ"...)
+	}
+	if len(db.ip6) > 0 && !done6 {
+		db.ip6 = appendAddr6(db.ip6, next6)
+		db.ip6txt = append(db.ip6txt, "ZZ"...)
+	}
+	return db, nil
+}
+
+func appendAddr6(ip6 []uint64, addr netip.Addr) []uint64 {
+	b := addr.As16()
+	return append(ip6, binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:]))
+}
+
+// parseRange parses both ends of a range, decimal ranges whose end
+// exceeds 32 bits are IPv6
+func parseRange(from, to string) (netip.Addr, netip.Addr, error) {
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	start, errStart := netip.ParseAddr(from)
+	end, errEnd := netip.ParseAddr(to)
+	if errStart == nil && errEnd == nil {
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return start, end, fmt.Errorf("invalid range %s-%s", from, to)
+		}
+		return start, end, nil
+	}
+	s, okStart := new(big.Int).SetString(from, 10)
+	e, okEnd := new(big.Int).SetString(to, 10)
+	if !okStart || !okEnd || s.Sign() < 0 || e.Cmp(s) < 0 || e.BitLen() > 128 {
+		return start, end, fmt.Errorf("invalid range %s-%s", from, to)
+	}
+	if e.BitLen() <= 32 {
+		return intToAddr(s, 4), intToAddr(e, 4), nil
+	}
+	return intToAddr(s, 16), intToAddr(e, 16), nil
+}
+
+func intToAddr(n *big.Int, size int) netip.Addr {
+	b := n.FillBytes(make([]byte, size))
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
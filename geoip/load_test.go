@@ -0,0 +1,149 @@
+package geoip
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// restoreDatabase puts the database loaded before the test back
+func restoreDatabase(t *testing.T) {
+	t.Helper()
+	old := current.Load()
+	t.Cleanup(func() { current.Store(old) })
+}
+
+func TestConcurrentLoadsAndLookups(t *testing.T) {
+	restoreDatabase(t)
+	var cache bytes.Buffer
+	if err := WriteCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	const ip4CSV = "1.0.0.0,1.255.255.255,AU\n"
+	const ip6CSV = "2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,DE\n"
+
+	stop := make(chan struct{})
+	var lookups sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		lookups.Add(1)
+		go func() {
+			defer lookups.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				Country("1.2.3.4")
+				Country("2001:db8::1")
+				KnownCountry("AU")
+				Countries()
+			}
+		}()
+	}
+	for round := 0; round < 3; round++ {
+		var loads sync.WaitGroup
+		loads.Add(3)
+		go func() {
+			defer loads.Done()
+			if err := LoadDBIPReader(strings.NewReader(ip4CSV)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer loads.Done()
+			if err := LoadDBIPReader(strings.NewReader(ip6CSV)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer loads.Done()
+			if err := LoadCacheBytes(cache.Bytes()); err != nil {
+				t.Error(err)
+			}
+		}()
+		loads.Wait()
+	}
+	close(stop)
+	lookups.Wait()
+}
+
+func TestConcurrentFamilyLoadsKeepBoth(t *testing.T) {
+	restoreDatabase(t)
+	for round := 0; round < 50; round++ {
+		code4, code6 := fmt.Sprintf("A%c", 'A'+round%26), "DE"
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := LoadDBIPReader(strings.NewReader("1.0.0.0,1.255.255.255," + code4 + "\n")); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := LoadDBIPReader(strings.NewReader("2001:db8::,2001:db8::ffff," + code6 + "\n")); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if got := Country("1.2.3.4"); got != code4 {
+			t.Fatalf("round %d: lost the ipv4 load, got %s want %s", round, got, code4)
+		}
+		if got := Country("2001:db8::1"); got != code6 {
+			t.Fatalf("round %d: lost the ipv6 load, got %s want %s", round, got, code6)
+		}
+	}
+}
+
+// loadCounter records the result label of database loads
+type loadCounter struct {
+	mu      sync.Mutex
+	results map[string]int
+}
+
+func (c *loadCounter) Add(_ float64, labels ...string) {
+	c.mu.Lock()
+	c.results[labels[0]]++
+	c.mu.Unlock()
+}
+
+func (c *loadCounter) Observe(float64, ...string) {}
+
+func (c *loadCounter) Counter(name, _ string, _ ...string) Counter {
+	if name == "geoip_database_loads_total" {
+		return c
+	}
+	return nopCounter{}
+}
+
+func (c *loadCounter) Histogram(string, string, ...string) Histogram {
+	return c
+}
+
+type nopCounter struct{}
+
+func (nopCounter) Add(float64, ...string) {}
+
+func TestLoadMetricsCountParseErrors(t *testing.T) {
+	restoreDatabase(t)
+	loads := &loadCounter{results: map[string]int{}}
+	SetMetrics(loads)
+	t.Cleanup(func() { SetMetrics(nil) })
+
+	if err := LoadDBIPReader(strings.NewReader("1.0.0.0,1.255.255.255,AU\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadDBIPReader(strings.NewReader("not,a,range\n")); err == nil {
+		t.Fatal("loading an invalid CSV succeeded")
+	}
+	if err := LoadCacheBytes([]byte("garbage")); err == nil {
+		t.Fatal("loading an invalid cache succeeded")
+	}
+	want := map[string]int{"ok": 1, "error": 2}
+	if fmt.Sprint(loads.results) != fmt.Sprint(want) {
+		t.Fatalf("load results %v, want %v", loads.results, want)
+	}
+}
@@ -0,0 +1,84 @@
+package geoip
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing metric, labels are the values
+// of the label names it was created with, in order.
+type Counter interface {
+	Add(delta float64, labels ...string)
+}
+
+// Histogram is a metric observing a distribution, e.g. durations in
+// seconds, labels are as for Counter.
+type Histogram interface {
+	Observe(value float64, labels ...string)
+}
+
+// Metrics creates the instruments of this module. It is a small
+// interface so any metrics library can be adapted to it without this
+// module depending on one. Instruments are created once, when set.
+// The github.com/oarkflow/ip/metrics/prometheus and .../metrics/otel
+// modules adapt Prometheus and OpenTelemetry to it.
+type Metrics interface {
+	Counter(name, help string, labels ...string) Counter
+	Histogram(name, help string, labels ...string) Histogram
+}
+
+// geoipMetrics are the instruments of the package
+type geoipMetrics struct {
+	lookups  Counter
+	loads    Counter
+	download Histogram
+}
+
+var metrics atomic.Pointer[geoipMetrics]
+
+// SetMetrics reports the metrics of the package to m, nil stops
+// reporting:
+//
+//	geoip_lookups_total{family}       country lookups by ipv4/ipv6
+//	geoip_database_loads_total{result} loads by ok/anomalous/error
+//	geoip_download_seconds{result}     download durations by ok/error
+func SetMetrics(m Metrics) {
+	if m == nil {
+		metrics.Store(nil)
+		return
+	}
+	metrics.Store(&geoipMetrics{
+		lookups:  m.Counter("geoip_lookups_total", "Country lookups.", "family"),
+		loads:    m.Counter("geoip_database_loads_total", "Database loads.", "result"),
+		download: m.Histogram("geoip_download_seconds", "Database download durations.", "result"),
+	})
+}
+
+func countLookup(family string) {
+	if m := metrics.Load(); m != nil {
+		m.lookups.Add(1, family)
+	}
+}
+
+func countLoad(err error) {
+	if m := metrics.Load(); m != nil {
+		m.loads.Add(1, errorResult(err))
+	}
+}
+
+func observeDownload(start time.Time, err error) {
+	if m := metrics.Load(); m != nil {
+		m.download.Observe(time.Since(start).Seconds(), errorResult(err))
+	}
+}
+
+func errorResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrAnomalousDatabase):
+		return "anomalous"
+	}
+	return "error"
+}
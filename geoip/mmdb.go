@@ -0,0 +1,241 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+)
+
+// ErrInvalidMMDB is returned for files which aren't a MaxMind DB.
+var ErrInvalidMMDB = errors.New("geoip: invalid MaxMind database")
+
+// mmdbMetadata starts the metadata section at the end of the file
+var mmdbMetadata = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMMDBDepth bounds nesting and pointer chains of corrupt files
+const maxMMDBDepth = 32
+
+// mmdb is a minimal reader of the MaxMind DB format, enough for the
+// flat records of databases like GeoIP2 Anonymous IP
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	dbType     string
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node of ::/96 in IPv6 trees
+	ipv4Start uint
+}
+
+func parseMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadata)
+	if i < 0 {
+		return nil, ErrInvalidMMDB
+	}
+	value, _, err := decodeMMDB(b[i+len(mmdbMetadata):], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := value.(map[string]any)
+	if !ok {
+		return nil, ErrInvalidMMDB
+	}
+	nodeCount := mmdbUint(meta["node_count"])
+	db := &mmdb{
+		recordSize: uint(mmdbUint(meta["record_size"])),
+		ipVersion:  uint(mmdbUint(meta["ip_version"])),
+	}
+	db.dbType, _ = meta["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, ErrInvalidMMDB
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, ErrInvalidMMDB
+	}
+	// two records per node, plus 16 zero bytes before the data. The
+	// node count is checked first so a corrupt one can't wrap the size.
+	if nodeCount > uint64(i)*4/uint64(db.recordSize) {
+		return nil, ErrInvalidMMDB
+	}
+	db.nodeCount = uint(nodeCount)
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, ErrInvalidMMDB
+	}
+	db.tree, db.data = b[:treeSize], b[treeSize+16:i]
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right record of node
+func (db *mmdb) record(node, bit uint) uint {
+	tree := db.tree
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(tree[off])<<16 | uint(tree[off+1])<<8 | uint(tree[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(tree[off+3]&0xf0)<<20 | uint(tree[off])<<16 | uint(tree[off+1])<<8 | uint(tree[off+2])
+		}
+		return uint(tree[off+3]&0x0f)<<24 | uint(tree[off+4])<<16 | uint(tree[off+5])<<8 | uint(tree[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the record of the network containing ip
+func (db *mmdb) lookup(ip net.IP) (any, bool) {
+	var node uint
+	bits := ip.To4()
+	if bits != nil {
+		node = db.ipv4Start
+	} else {
+		if db.ipVersion == 4 {
+			return nil, false
+		}
+		if bits = ip.To16(); bits == nil {
+			return nil, false
+		}
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return nil, false
+	}
+	value, _, err := decodeMMDB(db.data, node-db.nodeCount-16, 0)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// decodeMMDB decodes the value at off of a data section, returning
+// the offset following it
+func decodeMMDB(buf []byte, off uint, depth int) (any, uint, error) {
+	if depth > maxMMDBDepth || off >= uint(len(buf)) {
+		return nil, 0, ErrInvalidMMDB
+	}
+	ctrl := buf[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// pointer, its value is decoded in place
+		size := uint(ctrl>>3&3) + 1
+		if off+size > uint(len(buf)) {
+			return nil, 0, ErrInvalidMMDB
+		}
+		ptr := uint(ctrl & 7)
+		if size == 4 {
+			ptr = 0
+		}
+		for _, b := range buf[off : off+size] {
+			ptr = ptr<<8 | uint(b)
+		}
+		ptr += [...]uint{0, 2048, 526336, 0}[size-1]
+		value, _, err := decodeMMDB(buf, ptr, depth+1)
+		return value, off + size, err
+	}
+	if typ == 0 {
+		if off >= uint(len(buf)) {
+			return nil, 0, ErrInvalidMMDB
+		}
+		typ = 7 + uint(buf[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(buf)) {
+			return nil, 0, ErrInvalidMMDB
+		}
+		extra := uint(0)
+		for _, b := range buf[off : off+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+		off += n
+	}
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, min(size, 64))
+		for ; size > 0; size-- {
+			key, next, err := decodeMMDB(buf, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, ErrInvalidMMDB
+			}
+			if m[k], off, err = decodeMMDB(buf, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, 64))
+		for ; size > 0; size-- {
+			value, next, err := decodeMMDB(buf, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, value), next
+		}
+		return a, off, nil
+	case 14: // boolean, the size is the value
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(buf)) {
+		return nil, 0, ErrInvalidMMDB
+	}
+	payload := buf[off : off+size]
+	off += size
+	switch typ {
+	case 2: // string
+		return string(payload), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, ErrInvalidMMDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, ErrInvalidMMDB
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var n uint64
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		return n, off, nil
+	case 8: // int32
+		var n uint32
+		for _, b := range payload {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), off, nil
+	case 4, 10: // bytes, uint128
+		return bytes.Clone(payload), off, nil
+	case 12, 13: // data cache container, end marker
+		return nil, off, nil
+	}
+	return nil, 0, ErrInvalidMMDB
+}
+
+func mmdbUint(value any) uint64 {
+	n, _ := value.(uint64)
+	return n
+}
@@ -0,0 +1,352 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mmdbWriter builds small MaxMind DB files for the tests
+type mmdbWriter struct {
+	recordSize int
+	ipVersion  int
+	// nodes hold the left and right records, -1 when empty, a node
+	// index or dataRef plus a data offset
+	nodes [][2]int
+	data  []byte
+}
+
+// dataRef marks records pointing into the data section
+const dataRef = 1 << 30
+
+func newMMDBWriter(recordSize, ipVersion int) *mmdbWriter {
+	return &mmdbWriter{recordSize: recordSize, ipVersion: ipVersion, nodes: [][2]int{{-1, -1}}}
+}
+
+// insert points prefix at the data at off, IPv4 prefixes go to ::/96
+// of IPv6 trees
+func (w *mmdbWriter) insert(prefix string, off int) {
+	p := netip.MustParsePrefix(prefix)
+	addr, bits := p.Addr().AsSlice(), p.Bits()
+	if w.ipVersion == 6 && p.Addr().Is4() {
+		addr, bits = netip.AddrFrom16(p.Addr().As16()).AsSlice(), bits+96
+		// As16 maps to ::ffff:0:0/96, MaxMind uses ::/96
+		addr[10], addr[11] = 0, 0
+	}
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(addr[i/8]>>(7-i%8)) & 1
+		if i == bits-1 {
+			w.nodes[node][bit] = dataRef + off
+			return
+		}
+		next := w.nodes[node][bit]
+		if next < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			next = len(w.nodes) - 1
+			w.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+// add appends a value to the data section and returns its offset
+func (w *mmdbWriter) add(value []byte) int {
+	off := len(w.data)
+	w.data = append(w.data, value...)
+	return off
+}
+
+func (w *mmdbWriter) bytes(dbType string) []byte {
+	n := len(w.nodes)
+	resolve := func(record int) uint32 {
+		switch {
+		case record < 0:
+			return uint32(n)
+		case record >= dataRef:
+			return uint32(n + 16 + record - dataRef)
+		}
+		return uint32(record)
+	}
+	var b []byte
+	for _, node := range w.nodes {
+		left, right := resolve(node[0]), resolve(node[1])
+		switch w.recordSize {
+		case 24:
+			b = append(b, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			b = append(b, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0xf)<<4|byte(right>>24&0xf),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			b = binary.BigEndian.AppendUint32(b, left)
+			b = binary.BigEndian.AppendUint32(b, right)
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, w.data...)
+	b = append(b, mmdbMetadata...)
+	return append(b, mmdbMap(
+		"binary_format_major_version", mmdbUint16(2),
+		"database_type", mmdbString(dbType),
+		"ip_version", mmdbUint16(uint16(w.ipVersion)),
+		"languages", mmdbArray(mmdbString("en")),
+		"node_count", mmdbUint32(uint32(n)),
+		"record_size", mmdbUint16(uint16(w.recordSize)),
+	)...)
+}
+
+// mmdbCtrl encodes a control byte and size for type typ
+func mmdbCtrl(typ, size int) []byte {
+	var b []byte
+	var sizeBits byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, b = 29, []byte{byte(size - 29)}
+	default:
+		size -= 285
+		sizeBits, b = 30, []byte{byte(size >> 8), byte(size)}
+	}
+	if typ > 7 {
+		return append([]byte{sizeBits, byte(typ - 7)}, b...)
+	}
+	return append([]byte{byte(typ)<<5 | sizeBits}, b...)
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbCtrl(2, len(s)), s...)
+}
+
+func mmdbBool(v bool) []byte {
+	if v {
+		return mmdbCtrl(14, 1)
+	}
+	return mmdbCtrl(14, 0)
+}
+
+func mmdbUint16(n uint16) []byte {
+	return append(mmdbCtrl(5, 2), byte(n>>8), byte(n))
+}
+
+func mmdbUint32(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(mmdbCtrl(6, 4), n)
+}
+
+func mmdbArray(values ...[]byte) []byte {
+	b := mmdbCtrl(11, len(values))
+	for _, v := range values {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// mmdbMap encodes alternating keys (strings or encoded values, e.g.
+// pointers) and encoded values
+func mmdbMap(kv ...any) []byte {
+	b := mmdbCtrl(7, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		switch key := kv[i].(type) {
+		case string:
+			b = append(b, mmdbString(key)...)
+		case []byte:
+			b = append(b, key...)
+		}
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+// mmdbPointer encodes a pointer of the smallest size holding off
+func mmdbPointer(off int) []byte {
+	switch {
+	case off < 2048:
+		return []byte{0x20 | byte(off>>8), byte(off)}
+	case off < 526336:
+		off -= 2048
+		return []byte{0x28 | byte(off>>16), byte(off >> 8), byte(off)}
+	case off < 134744064:
+		off -= 526336
+		return []byte{0x30 | byte(off>>24), byte(off >> 16), byte(off >> 8), byte(off)}
+	}
+	return binary.BigEndian.AppendUint32([]byte{0x38}, uint32(off))
+}
+
+// anonymousFixture is an Anonymous IP database with a VPN /24 and a
+// Tor /16, plus a public proxy IPv6 /32 in IPv6 trees. The Tor record
+// refers to the key of the VPN record with a pointer.
+func anonymousFixture(recordSize, ipVersion int) []byte {
+	w := newMMDBWriter(recordSize, ipVersion)
+	vpn := w.add(mmdbMap("is_anonymous", mmdbBool(true), "is_anonymous_vpn", mmdbBool(true)))
+	// the key string "is_anonymous" follows the map control byte
+	tor := w.add(mmdbMap(mmdbPointer(vpn+1), mmdbBool(true), "is_tor_exit_node", mmdbBool(true)))
+	w.insert("1.2.3.0/24", vpn)
+	w.insert("5.6.0.0/16", tor)
+	if ipVersion == 6 {
+		proxy := w.add(mmdbMap("is_anonymous", mmdbBool(true), "is_public_proxy", mmdbBool(true)))
+		w.insert("2001:db8::/32", proxy)
+	}
+	return w.bytes("GeoIP2-Anonymous-IP")
+}
+
+func TestAnonymousIPLookups(t *testing.T) {
+	vpn := AnonymousIP{IsAnonymous: true, IsAnonymousVPN: true}
+	tor := AnonymousIP{IsAnonymous: true, IsTorExitNode: true}
+	proxy := AnonymousIP{IsAnonymous: true, IsPublicProxy: true}
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			db, err := LoadAnonymousIP(anonymousFixture(recordSize, ipVersion))
+			if err != nil {
+				t.Fatalf("record size %d, IPv%d: %v", recordSize, ipVersion, err)
+			}
+			tests := []struct {
+				ip   string
+				want AnonymousIP
+				ok   bool
+			}{
+				{"1.2.3.4", vpn, true},
+				{"1.2.3.255", vpn, true},
+				{"1.2.4.1", AnonymousIP{}, false},
+				{"5.6.7.8", tor, true},
+				{"5.7.0.1", AnonymousIP{}, false},
+				{"2001:db8::1", proxy, ipVersion == 6},
+				{"2001:db9::1", AnonymousIP{}, false},
+			}
+			for _, tt := range tests {
+				got, ok := db.AnonymousIP(net.ParseIP(tt.ip))
+				if !tt.ok {
+					tt.want = AnonymousIP{}
+				}
+				if ok != tt.ok || got != tt.want {
+					t.Errorf("record size %d, IPv%d: %s = %+v, %v, want %+v, %v",
+						recordSize, ipVersion, tt.ip, got, ok, tt.want, tt.ok)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBRecord(t *testing.T) {
+	tests := []struct {
+		recordSize  uint
+		tree        []byte
+		left, right uint
+	}{
+		{24, []byte{0x12, 0x34, 0x56, 0x65, 0x43, 0x21}, 0x123456, 0x654321},
+		// the middle byte holds the high nibbles of both records
+		{28, []byte{0x12, 0x34, 0x56, 0xa5, 0x65, 0x43, 0x21}, 0xa123456, 0x5654321},
+		{32, []byte{0xf1, 0x23, 0x45, 0x67, 0x76, 0x54, 0x32, 0x1f}, 0xf1234567, 0x7654321f},
+	}
+	for _, tt := range tests {
+		db := &mmdb{tree: tt.tree, recordSize: tt.recordSize, nodeCount: 1}
+		if left, right := db.record(0, 0), db.record(0, 1); left != tt.left || right != tt.right {
+			t.Errorf("record size %d: records %#x, %#x, want %#x, %#x", tt.recordSize, left, right, tt.left, tt.right)
+		}
+	}
+}
+
+func TestDecodeMMDB(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	double := binary.BigEndian.AppendUint64(mmdbCtrl(3, 8), math.Float64bits(1.5))
+	float := binary.BigEndian.AppendUint32(mmdbCtrl(15, 4), math.Float32bits(2.5))
+	tests := []struct {
+		name string
+		buf  []byte
+		off  uint
+		want any
+	}{
+		{"string", mmdbString("abc"), 0, "abc"},
+		{"long string", mmdbString(long), 0, long},
+		{"empty string", mmdbString(""), 0, ""},
+		{"uint16", mmdbUint16(65535), 0, uint64(65535)},
+		{"uint32", mmdbUint32(1 << 31), 0, uint64(1 << 31)},
+		{"uint64", append(mmdbCtrl(9, 3), 1, 2, 3), 0, uint64(0x010203)},
+		{"int32", append(mmdbCtrl(8, 4), 0xff, 0xff, 0xff, 0xfe), 0, int64(-2)},
+		{"double", double, 0, 1.5},
+		{"float", float, 0, float32(2.5)},
+		{"bytes", append(mmdbCtrl(4, 2), 0xca, 0xfe), 0, []byte{0xca, 0xfe}},
+		{"true", mmdbBool(true), 0, true},
+		{"false", mmdbBool(false), 0, false},
+		{"array", mmdbArray(mmdbString("a"), mmdbBool(true)), 0, []any{"a", true}},
+		{"map", mmdbMap("k", mmdbString("v")), 0, map[string]any{"k": "v"}},
+		{"pointer", append(mmdbString("target"), mmdbPointer(0)...), 7, "target"},
+		{"pointer size 2", append(append(make([]byte, 3000), mmdbString("far")...), mmdbPointer(3000)...), 3004, "far"},
+		{"pointer size 3", append(append(make([]byte, 530000), mmdbString("farther")...), mmdbPointer(530000)...), 530008, "farther"},
+	}
+	for _, tt := range tests {
+		got, _, err := decodeMMDB(tt.buf, tt.off, 0)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidMMDB(t *testing.T) {
+	valid := anonymousFixture(24, 6)
+	marker := strings.LastIndex(string(valid), string(mmdbMetadata))
+	withMeta := func(kv ...any) []byte {
+		b := append([]byte{}, valid[:marker+len(mmdbMetadata)]...)
+		return append(b, mmdbMap(kv...)...)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"no metadata", valid[:marker]},
+		{"truncated metadata", valid[:len(valid)-3]},
+		{"metadata not a map", append(valid[:marker+len(mmdbMetadata):marker+len(mmdbMetadata)], mmdbString("x")...)},
+		{"record size", withMeta("node_count", mmdbUint32(3), "record_size", mmdbUint16(20), "ip_version", mmdbUint16(6))},
+		{"ip version", withMeta("node_count", mmdbUint32(3), "record_size", mmdbUint16(24), "ip_version", mmdbUint16(5))},
+		{"tree past the data", withMeta("node_count", mmdbUint32(1<<20), "record_size", mmdbUint16(24), "ip_version", mmdbUint16(6))},
+		{"wrapping node count", withMeta(
+			"node_count", append(mmdbCtrl(9, 8), 0x40, 0, 0, 0, 0, 0, 0, 0),
+			"record_size", mmdbUint16(32), "ip_version", mmdbUint16(6))},
+		{"pointer loop", withMeta("node_count", mmdbPointer(0))},
+	}
+	for _, tt := range tests {
+		if _, err := parseMMDB(tt.b); !errors.Is(err, ErrInvalidMMDB) {
+			t.Errorf("%s: error %v, want ErrInvalidMMDB", tt.name, err)
+		}
+	}
+}
+
+// TestCorruptMMDB parses and queries truncated and randomly corrupted
+// copies of a valid database, which may fail but must not panic
+func TestCorruptMMDB(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8"), net.ParseIP("2001:db8::1"), net.ParseIP("::")}
+	query := func(b []byte) {
+		db, err := parseMMDB(b)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidMMDB) {
+				t.Fatalf("error %v, want ErrInvalidMMDB", err)
+			}
+			return
+		}
+		for _, ip := range ips {
+			db.lookup(ip)
+		}
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		valid := anonymousFixture(recordSize, 6)
+		for n := range valid {
+			query(valid[:n])
+		}
+		rnd := rand.New(rand.NewSource(int64(recordSize)))
+		for i := 0; i < 2000; i++ {
+			b := append([]byte{}, valid...)
+			for j := 0; j < 1+rnd.Intn(4); j++ {
+				b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+			}
+			query(b)
+		}
+	}
+}
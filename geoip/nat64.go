@@ -0,0 +1,72 @@
+package geoip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// nat64Prefix is a NAT64 prefix, its length is a multiple of 8
+type nat64Prefix struct {
+	addr [16]byte
+	size int // in bytes
+}
+
+// WellKnownNAT64Prefix is the prefix of RFC 6052, used by most NAT64
+// gateways and looked up by default.
+const WellKnownNAT64Prefix = "64:ff9b::/96"
+
+var nat64Prefixes atomic.Pointer[[]nat64Prefix]
+
+func init() {
+	_ = SetNAT64Prefixes(WellKnownNAT64Prefix)
+}
+
+// SetNAT64Prefixes replaces the NAT64 prefixes, WellKnownNAT64Prefix
+// by default. Lookups of IPv6 addresses synthesized within them resolve
+// the embedded IPv4 address, as IPv6-only clients behind NAT64 would
+// otherwise be unknown. Prefixes must be /32, /40, /48, /56, /64 or /96
+// as in RFC 6052, none disables the translation.
+func SetNAT64Prefixes(prefixes ...string) error {
+	parsed := make([]nat64Prefix, 0, len(prefixes))
+	for _, str := range prefixes {
+		p, err := netip.ParsePrefix(str)
+		if err != nil {
+			return err
+		}
+		switch p.Bits() {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return fmt.Errorf("geoip: NAT64 prefix %s must be /32, /40, /48, /56, /64 or /96", str)
+		}
+		if !p.Addr().Is6() || p.Addr().Is4In6() {
+			return fmt.Errorf("geoip: NAT64 prefix %s is not IPv6", str)
+		}
+		parsed = append(parsed, nat64Prefix{addr: p.Masked().Addr().As16(), size: p.Bits() / 8})
+	}
+	nat64Prefixes.Store(&parsed)
+	return nil
+}
+
+// nat64Embedded returns the IPv4 address embedded in ip when it is
+// within a NAT64 prefix, the octet 64-71 is skipped as in RFC 6052
+func nat64Embedded(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+	for _, p := range *nat64Prefixes.Load() {
+		if !bytes.Equal(ip[:p.size], p.addr[:p.size]) {
+			continue
+		}
+		v4 := make(net.IP, 0, net.IPv4len)
+		for i := p.size; len(v4) < net.IPv4len; i++ {
+			if i != 8 {
+				v4 = append(v4, ip[i])
+			}
+		}
+		return v4
+	}
+	return nil
+}
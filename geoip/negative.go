@@ -0,0 +1,53 @@
+package geoip
+
+import (
+	"bytes"
+	"math"
+)
+
+// unknown is returned for addresses in ranges without a country.
+var unknown = []byte("ZZ")
+
+// prefixSet is a bitset of 16 bit address prefixes, the first two
+// octets of an IPv4 address or the first hextet of an IPv6 address.
+type prefixSet [1 << 16 / 64]uint64
+
+func (s *prefixSet) set(from, to uint16) {
+	for p := uint32(from); p <= uint32(to); p++ {
+		s[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (s *prefixSet) has(p uint16) bool {
+	return s[p/64]&(1<<(p%64)) != 0
+}
+
+// loadKnown marks every prefix holding at least one range with a
+// country. Lookups in unmarked prefixes (reserved, unallocated and
+// bogon space) answer "ZZ" without searching the ranges.
+func (db *database) loadKnown() {
+	for i, start := range db.ip4 {
+		if bytes.Equal(db.ip4txt[i*2:i*2+2], unknown) {
+			continue
+		}
+		end := uint32(math.MaxUint32)
+		if i+1 < len(db.ip4) {
+			end = db.ip4[i+1] - 1
+		}
+		db.known4.set(uint16(start>>16), uint16(end>>16))
+	}
+	for i := 0; i+1 < len(db.ip6); i += 2 {
+		if bytes.Equal(db.ip6txt[i:i+2], unknown) {
+			continue
+		}
+		// the range ends right before the next one starts
+		end := uint64(math.MaxUint64)
+		if i+3 < len(db.ip6) {
+			end = db.ip6[i+2]
+			if db.ip6[i+3] == 0 {
+				end--
+			}
+		}
+		db.known6.set(uint16(db.ip6[i]>>48), uint16(end>>48))
+	}
+}
@@ -0,0 +1,125 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oarkflow/ip/ctx"
+)
+
+// Provider describes how a load balancer or CDN passes the client IP,
+// so FromRequest reads the right header and only trusts it from the
+// provider's own addresses.
+type Provider struct {
+	Name string
+	// Header carrying the client IP
+	Header string
+	// Hops is, for comma separated lists such as X-Forwarded-For, how
+	// many entries the provider appends after the client IP
+	Hops int
+	// TrustedProxies are the CIDRs the header is accepted from, the
+	// header of any peer is trusted when empty
+	TrustedProxies []string
+
+	nets []*net.IPNet
+}
+
+var (
+	// Cloudflare sets CF-Connecting-IP, trusted from Cloudflare's
+	// published ranges.
+	Cloudflare = Provider{
+		Name:   "cloudflare",
+		Header: "CF-Connecting-IP",
+		TrustedProxies: []string{
+			"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22",
+			"103.31.4.0/22", "141.101.64.0/18", "108.162.192.0/18",
+			"190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22",
+			"198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+			"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+			"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32",
+			"2405:b500::/32", "2405:8100::/32", "2a06:98c0::/29",
+			"2c0f:f248::/32",
+		},
+	}
+	// AWSALB appends the client IP to X-Forwarded-For and connects from
+	// the private addresses of the VPC.
+	AWSALB = Provider{
+		Name:           "aws-alb",
+		Header:         "X-Forwarded-For",
+		TrustedProxies: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	}
+	// GCPLB appends "<client>, <load balancer>" to X-Forwarded-For and
+	// connects from Google's front end ranges.
+	GCPLB = Provider{
+		Name:           "gcp-lb",
+		Header:         "X-Forwarded-For",
+		Hops:           1,
+		TrustedProxies: []string{"35.191.0.0/16", "130.211.0.0/22"},
+	}
+	// Fastly sets Fastly-Client-IP. Set TrustedProxies to the ranges at
+	// https://api.fastly.com/public-ip-list to reject spoofed headers.
+	Fastly = Provider{
+		Name:   "fastly",
+		Header: "Fastly-Client-IP",
+	}
+	// Akamai sets True-Client-IP. Akamai doesn't publish its ranges, set
+	// TrustedProxies to the ones of your contract to reject spoofing.
+	Akamai = Provider{
+		Name:   "akamai",
+		Header: "True-Client-IP",
+	}
+)
+
+var provider atomic.Pointer[Provider]
+
+// UseProvider makes FromRequest read the client IP the way p passes it,
+// instead of trying the common proxy headers in turn.
+func UseProvider(p Provider) {
+	provider.Store(NewProvider(p))
+}
+
+// NewProvider returns p with its TrustedProxies parsed, for
+// FromRequestWith. Invalid CIDRs are ignored.
+func NewProvider(p Provider) *Provider {
+	p.nets = make([]*net.IPNet, 0, len(p.TrustedProxies))
+	for _, cidr := range p.TrustedProxies {
+		if _, nt, err := net.ParseCIDR(cidr); err == nil {
+			p.nets = append(p.nets, nt)
+		}
+	}
+	return &p
+}
+
+// ResetProvider restores the default header detection of FromRequest.
+func ResetProvider() {
+	provider.Store(nil)
+}
+
+// fromProvider returns the client IP passed by p, or an empty string
+// when the peer isn't trusted or the header is missing
+func (p *Provider) fromProvider(c ctx.Context) string {
+	if len(p.nets) > 0 {
+		peer := net.ParseIP(c.ClientIP())
+		trusted := false
+		for _, nt := range p.nets {
+			if peer != nil && nt.Contains(peer) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return ""
+		}
+	}
+	values := strings.Split(string(c.GetHeader(p.Header)), ",")
+	i := len(values) - 1 - p.Hops
+	if i < 0 {
+		return ""
+	}
+	ip := net.ParseIP(strings.TrimSpace(values[i]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
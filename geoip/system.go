@@ -0,0 +1,48 @@
+package geoip
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Clock tells the time, replace it to test cache expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+// FS is the filesystem the download cache is kept in. Names are
+// passed as given to DownloadConfig.CachePath, so unlike an fs.FS an
+// implementation decides what a valid name is, e.g. any OS path for
+// OSFS.
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// SystemClock is the real clock.
+var SystemClock Clock = systemClock{}
+
+// OSFS is the local filesystem, names are OS paths.
+var OSFS FS = osFS{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
@@ -0,0 +1,212 @@
+package ip
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHostResolveInterval is how often host rules are re-resolved
+// when Config.HostResolveInterval is not set.
+const DefaultHostResolveInterval = 5 * time.Minute
+
+// hostResolveTimeout bounds a single host lookup
+const hostResolveTimeout = 5 * time.Second
+
+type hostRule struct {
+	stat    ruleStat
+	ips     []string
+	allowed bool
+}
+
+// AllowHost allows the A/AAAA records of host, keeping them in sync
+// with DNS, e.g. for offices with dynamic IPs.
+func (f *Filter) AllowHost(host string) error {
+	return f.ToggleHost(host, true)
+}
+
+// BlockHost blocks the A/AAAA records of host, keeping them in sync
+// with DNS.
+func (f *Filter) BlockHost(host string) error {
+	return f.ToggleHost(host, false)
+}
+
+// ToggleHost resolves host and applies allowed to its addresses. The
+// host is re-resolved every Config.HostResolveInterval until removed
+// with RemoveHost or the filter is closed; failed lookups keep the
+// previously resolved addresses. The rule is kept when the first lookup
+// fails, the error is returned and the host is retried with the others.
+// Single IP rules take precedence over host rules, which take
+// precedence over subnets.
+func (f *Filter) ToggleHost(host string, allowed bool) error {
+	ips, err := resolveHost(host)
+	f.setHost(host, allowed, ips, err)
+	return err
+}
+
+// setHost stores a host rule with the result of its first lookup,
+// keeping the previous addresses when it failed
+func (f *Filter) setHost(host string, allowed bool, ips []string, err error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	rule, ok := f.hosts[host]
+	if !ok {
+		rule = &hostRule{}
+		f.hosts[host] = rule
+	}
+	rule.allowed = allowed
+	if err == nil {
+		rule.ips = ips
+	}
+	f.rebuildHostIPs()
+	f.startResolvingHosts()
+}
+
+// addHosts adds the host rules of a configuration, resolving them all
+// at once so a slow lookup doesn't delay the others. Failed lookups
+// are logged and retried with the other hosts.
+func (f *Filter) addHosts(blocked, allowed []string) {
+	if len(blocked) == 0 && len(allowed) == 0 {
+		return
+	}
+	f.mut.Lock()
+	for _, host := range blocked {
+		f.hosts[host] = &hostRule{}
+	}
+	for _, host := range allowed {
+		f.hosts[host] = &hostRule{allowed: true}
+	}
+	f.startResolvingHosts()
+	f.mut.Unlock()
+	f.refreshHosts()
+}
+
+// startResolvingHosts must be called with the write lock held
+func (f *Filter) startResolvingHosts() {
+	if f.stopHosts != nil {
+		return
+	}
+	interval := f.opts.HostResolveInterval
+	if interval <= 0 {
+		interval = DefaultHostResolveInterval
+	}
+	f.stopHosts = make(chan struct{})
+	go f.resolveHosts(f.stopHosts, interval)
+}
+
+// RemoveHost drops a host rule and its addresses.
+func (f *Filter) RemoveHost(host string) {
+	f.mut.Lock()
+	delete(f.hosts, host)
+	f.rebuildHostIPs()
+	f.mut.Unlock()
+}
+
+// Close stops re-resolving host rules and retrying the download of
+// the geo database.
+func (f *Filter) Close() {
+	f.mut.Lock()
+	if f.stopHosts != nil {
+		close(f.stopHosts)
+		f.stopHosts = nil
+	}
+	if f.stopDownload != nil {
+		close(f.stopDownload)
+		f.stopDownload = nil
+	}
+	f.mut.Unlock()
+}
+
+func (f *Filter) resolveHosts(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.refreshHosts()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshHosts re-resolves every host concurrently, without holding
+// the lock during lookups
+func (f *Filter) refreshHosts() {
+	f.mut.RLock()
+	hosts := make([]string, 0, len(f.hosts))
+	for host := range f.hosts {
+		hosts = append(hosts, host)
+	}
+	f.mut.RUnlock()
+	resolved := make([][]string, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			ips, err := resolveHost(host)
+			if err != nil {
+				if f.opts.Logger != nil {
+					f.opts.Logger.Printf("ip filter: resolving %s: %v", host, err)
+				}
+				return
+			}
+			resolved[i] = ips
+		}(i, host)
+	}
+	wg.Wait()
+	f.mut.Lock()
+	for i, host := range hosts {
+		// skip failed lookups and hosts removed during the lookups
+		if rule, ok := f.hosts[host]; ok && resolved[i] != nil {
+			rule.ips = resolved[i]
+		}
+	}
+	f.rebuildHostIPs()
+	f.mut.Unlock()
+}
+
+// rebuildHostIPs must be called with the write lock held. An address
+// of both an allowed and a blocked host is allowed, as with subnets.
+func (f *Filter) rebuildHostIPs() {
+	hostIPs := map[string]*hostRule{}
+	for _, rule := range f.hosts {
+		for _, ip := range rule.ips {
+			if other, ok := hostIPs[ip]; !ok || !other.allowed {
+				hostIPs[ip] = rule
+			}
+		}
+	}
+	f.hostIPs = hostIPs
+}
+
+func resolveHost(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hostResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips, nil
+}
+
+// AllowHost allows the addresses of host, re-resolving them periodically
+func AllowHost(host string) error {
+	return filter.AllowHost(host)
+}
+
+// BlockHost blocks the addresses of host, re-resolving them periodically
+func BlockHost(host string) error {
+	return filter.BlockHost(host)
+}
+
+// RemoveHost drops a host rule
+func RemoveHost(host string) {
+	filter.RemoveHost(host)
+}
@@ -21,10 +21,27 @@ func CountryByNetIP(ip net.IP) string {
 	return geoip.CountryByIP(ip)
 }
 
+// Detect stores the client IP and country in the context, read them
+// back with FromContext. They are also kept under the "ip" and
+// "ip_country" keys.
 func Detect(ctx context.Context, c ctx.Context) {
-	ip := FromRequest(c)
-	c.Set("ip", ip)
-	c.Set("ip_country", Country(ip))
+	detect(ctx, c, "ip", "ip_country")
+}
+
+// detectWith returns Detect storing the IP and country under ipKey
+// and countryKey
+func detectWith(ipKey, countryKey string) HandlerFunc {
+	return func(ctx context.Context, c ctx.Context) {
+		detect(ctx, c, ipKey, countryKey)
+	}
+}
+
+func detect(ctx context.Context, c ctx.Context, ipKey, countryKey string) {
+	info := ClientInfo{IP: FromRequest(c)}
+	info.Country = Country(info.IP)
+	c.Set(ipKey, info.IP)
+	c.Set(countryKey, info.Country)
+	c.Set(clientInfoKey, info)
 	c.Next(ctx)
 }
 
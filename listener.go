@@ -0,0 +1,97 @@
+package ip
+
+import (
+	"net"
+	"time"
+)
+
+// addrIP returns the IP of a remote address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// passes reports if a peer at addr gets through the filter, including
+// its country rate limit. A nil filter is the one built by NewFilter.
+func (f *Filter) passes(addr net.Addr) bool {
+	if f == nil {
+		f = filter
+	}
+	start := time.Now()
+	ip := addrIP(addr)
+	allowed, code, byCountry := f.evaluate(ip, nil)
+	if !allowed {
+		f.decided(ip.String(), code, false, false, start)
+		return false
+	}
+	if byCountry && f.rateLimited(ip.String(), code) {
+		f.decided(ip.String(), code, false, true, start)
+		return false
+	}
+	f.decided(ip.String(), code, true, false, start)
+	return true
+}
+
+// filteredListener closes connections from blocked peers on accept
+type filteredListener struct {
+	net.Listener
+	filter *Filter
+}
+
+// FilteredListener wraps l so that connections from addresses blocked
+// (or rate limited) by f are closed on accept, before the application
+// ever sees them. It gives non-HTTP servers, e.g. SMTP or game servers,
+// the same rule set as the middleware. A nil f uses the filter built by
+// NewFilter.
+func FilteredListener(l net.Listener, f *Filter) net.Listener {
+	return &filteredListener{Listener: l, filter: f}
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.passes(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+// filteredPacketConn drops packets from blocked peers on read
+type filteredPacketConn struct {
+	net.PacketConn
+	filter *Filter
+}
+
+// FilteredPacketConn wraps a UDP (or other packet) connection so that
+// ReadFrom silently drops packets from addresses blocked (or rate
+// limited) by f. A nil f uses the filter built by NewFilter.
+func FilteredPacketConn(c net.PacketConn, f *Filter) net.PacketConn {
+	return &filteredPacketConn{PacketConn: c, filter: f}
+}
+
+func (c *filteredPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.filter.passes(addr) {
+			return n, addr, err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package otel adapts an OpenTelemetry meter to the metrics interface
+// of github.com/oarkflow/ip, for geoip.SetMetrics and Config.Metrics.
+// It is a separate module so the core one stays free of dependencies.
+//
+//	m := otel.New(provider.Meter("github.com/oarkflow/ip"))
+//	geoip.SetMetrics(m)
+//	ip.NewFilter(ip.Config{Metrics: m})
+package otel
+
+import (
+	"context"
+
+	"github.com/oarkflow/ip/geoip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics creates OpenTelemetry instruments for the ip module, the
+// label names become attribute keys.
+type Metrics struct {
+	meter metric.Meter
+}
+
+var _ geoip.Metrics = (*Metrics)(nil)
+
+// New returns Metrics creating its instruments with meter.
+func New(meter metric.Meter) *Metrics {
+	return &Metrics{meter: meter}
+}
+
+// Counter returns a float64 counter. Errors creating it are reported
+// to otel.Handle, the returned instrument then does nothing.
+func (m *Metrics) Counter(name, help string, labels ...string) geoip.Counter {
+	c, err := m.meter.Float64Counter(name, metric.WithDescription(help))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return counter{c: c, keys: labels}
+}
+
+// Histogram returns a float64 histogram, durations are in seconds.
+func (m *Metrics) Histogram(name, help string, labels ...string) geoip.Histogram {
+	h, err := m.meter.Float64Histogram(name, metric.WithDescription(help), metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return histogram{h: h, keys: labels}
+}
+
+// attributes pairs the label names with the values of a measurement
+func attributes(keys, values []string) metric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, min(len(keys), len(values)))
+	for i := range attrs {
+		attrs[i] = attribute.String(keys[i], values[i])
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+type counter struct {
+	c    metric.Float64Counter
+	keys []string
+}
+
+func (c counter) Add(delta float64, labels ...string) {
+	if c.c != nil {
+		c.c.Add(context.Background(), delta, attributes(c.keys, labels))
+	}
+}
+
+type histogram struct {
+	h    metric.Float64Histogram
+	keys []string
+}
+
+func (h histogram) Observe(value float64, labels ...string) {
+	if h.h != nil {
+		h.h.Record(context.Background(), value, attributes(h.keys, labels))
+	}
+}
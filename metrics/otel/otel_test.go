@@ -0,0 +1,43 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	m := New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test"))
+	m.Counter("test_total", "Test counter.", "result").Add(2, "ok")
+	m.Histogram("test_seconds", "Test histogram.", "result").Observe(0.3, "error")
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, metric := range sm.Metrics {
+			switch data := metric.Data.(type) {
+			case metricdata.Sum[float64]:
+				dp := data.DataPoints[0]
+				if v, _ := dp.Attributes.Value("result"); dp.Value != 2 || v != attribute.StringValue("ok") {
+					t.Errorf("%s: %v %v", metric.Name, dp.Value, dp.Attributes)
+				}
+			case metricdata.Histogram[float64]:
+				dp := data.DataPoints[0]
+				if v, _ := dp.Attributes.Value("result"); dp.Count != 1 || v != attribute.StringValue("error") {
+					t.Errorf("%s: %d %v", metric.Name, dp.Count, dp.Attributes)
+				}
+			}
+			found[metric.Name] = true
+		}
+	}
+	if !found["test_total"] || !found["test_seconds"] {
+		t.Errorf("collected %v", found)
+	}
+}
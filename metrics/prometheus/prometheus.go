@@ -0,0 +1,81 @@
+// Package prometheus adapts a Prometheus registry to the metrics
+// interface of github.com/oarkflow/ip, for geoip.SetMetrics and
+// Config.Metrics. It is a separate module so the core one stays free
+// of dependencies.
+//
+//	m := prometheus.New(nil)
+//	geoip.SetMetrics(m)
+//	ip.NewFilter(ip.Config{Metrics: m})
+package prometheus
+
+import (
+	"errors"
+
+	"github.com/oarkflow/ip/geoip"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics creates Prometheus collectors for the instruments of the ip
+// module and registers them.
+type Metrics struct {
+	reg prometheus.Registerer
+	// Buckets of the histograms, prometheus.DefBuckets when nil
+	Buckets []float64
+}
+
+var _ geoip.Metrics = (*Metrics)(nil)
+
+// New returns Metrics registering into reg, or into
+// prometheus.DefaultRegisterer when reg is nil.
+func New(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Metrics{reg: reg}
+}
+
+// Counter returns a counter vector. Instruments created again under
+// the same name, e.g. by a second filter, share the registered one.
+func (m *Metrics) Counter(name, help string, labels ...string) geoip.Counter {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	return counter{register(m.reg, vec)}
+}
+
+// Histogram returns a histogram vector, shared like Counter.
+func (m *Metrics) Histogram(name, help string, labels ...string) geoip.Histogram {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: m.Buckets}, labels)
+	return histogram{register(m.reg, vec)}
+}
+
+// register registers c, returning the already registered collector
+// of the same name instead. Other registration errors are a
+// programming error, as with prometheus.MustRegister.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) C {
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(C); ok {
+			return existing
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+type counter struct {
+	vec *prometheus.CounterVec
+}
+
+func (c counter) Add(delta float64, labels ...string) {
+	c.vec.WithLabelValues(labels...).Add(delta)
+}
+
+type histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+func (h histogram) Observe(value float64, labels ...string) {
+	h.vec.WithLabelValues(labels...).Observe(value)
+}
@@ -0,0 +1,30 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+	m.Counter("test_total", "Test counter.", "result").Add(2, "ok")
+	// a second instrument of the same name shares the first one
+	m.Counter("test_total", "Test counter.", "result").Add(1, "ok")
+	m.Histogram("test_seconds", "Test histogram.", "result").Observe(0.3, "error")
+
+	want := `
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{result="ok"} 3
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "test_total"); err != nil {
+		t.Error(err)
+	}
+	if n, err := testutil.GatherAndCount(reg, "test_seconds"); err != nil || n != 1 {
+		t.Errorf("%d histogram series, %v", n, err)
+	}
+}
@@ -0,0 +1,388 @@
+package ip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oarkflow/ip/ctx"
+	"github.com/oarkflow/ip/geoip"
+)
+
+// PolicyAction is what a policy rule does with a matching request.
+type PolicyAction string
+
+const (
+	// ActionAllow lets the request through, ending the evaluation.
+	ActionAllow PolicyAction = "allow"
+	// ActionDeny blocks the request, ending the evaluation.
+	ActionDeny PolicyAction = "deny"
+	// ActionRateLimit limits each IP to Limit requests per minute, the
+	// evaluation continues while the IP is within its limit.
+	ActionRateLimit PolicyAction = "rate_limit"
+	// ActionTag adds Tag to the request, the evaluation continues.
+	ActionTag PolicyAction = "tag"
+)
+
+// PolicyTagsKey is the context key of the tags added by ActionTag rules.
+const PolicyTagsKey = "ip_tags"
+
+// TimeWindow matches requests made between From and To ("15:04"), on
+// Days ("mon" to "sun", any day when empty), in Location (UTC when
+// empty). A From after To spans midnight, equal times the whole day.
+type TimeWindow struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Days     []string `json:"days,omitempty"`
+	Location string   `json:"location,omitempty"`
+}
+
+// PolicyRule matches requests on all of its set matchers and applies
+// Action to them. A rule without matchers matches every request.
+type PolicyRule struct {
+	Name string `json:"name,omitempty"`
+	// IPs accepts the notations of ToggleIP except host names: IPs,
+	// CIDRs, wildcards and ranges
+	IPs       []string `json:"ips,omitempty"`
+	Countries []string `json:"countries,omitempty"`
+	// Headers must all be present with the given value, an empty value
+	// only requires the header to be present and not empty, as most
+	// frameworks don't tell an empty header from a missing one
+	Headers map[string]string `json:"headers,omitempty"`
+	Time    *TimeWindow       `json:"time,omitempty"`
+	Action  PolicyAction      `json:"action"`
+	// Limit is the per minute request limit of ActionRateLimit
+	Limit int `json:"limit,omitempty"`
+	// Tag is the tag added by ActionTag
+	Tag string `json:"tag,omitempty"`
+}
+
+// Policy is an ordered list of rules, the first allow or deny rule
+// matching a request decides it. Requests no such rule matches get the
+// Default action, which is allow when empty.
+//
+//	{
+//	  "default": "deny",
+//	  "rules": [
+//	    {"name": "office", "ips": ["10.1.*.*"], "action": "allow"},
+//	    {"name": "bots", "headers": {"X-Bot": ""}, "action": "tag", "tag": "bot"},
+//	    {"countries": ["DE", "FR"], "action": "rate_limit", "limit": 60},
+//	    {"countries": ["DE", "FR"], "time": {"from": "08:00", "to": "18:00"}, "action": "allow"}
+//	  ]
+//	}
+type Policy struct {
+	Default PolicyAction `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// ErrInvalidPolicy is wrapped by the errors of Policy.Compile.
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// ParsePolicy reads a JSON policy, unknown fields are rejected.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var p Policy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("ip policy: %w: %v", ErrInvalidPolicy, err)
+	}
+	return &p, nil
+}
+
+// LoadPolicyFile reads a JSON policy from path.
+func LoadPolicyFile(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParsePolicy(file)
+}
+
+// PolicyDecision is the outcome of a policy for a request.
+type PolicyDecision struct {
+	Allowed     bool
+	RateLimited bool
+	// Rule is the name (or #index) of the deciding rule, empty when
+	// the default action decided
+	Rule string
+	Tags []string
+}
+
+// PolicyEngine is a compiled Policy, it is safe for concurrent use.
+// Its rules are matched on their own, not through the lookup tables of
+// a Filter, so the filter features don't apply to policies: there is
+// no Explain, RuleStats, DecisionHook, Metrics or FailMode, rate_limit
+// rules replace CountryRateLimits, and host rules and
+// IPv6PrefixFallback aren't supported.
+type PolicyEngine struct {
+	rules          []*compiledRule
+	defaultAllowed bool
+}
+
+// compiledRule holds the matchers of a rule in lookup structures
+type compiledRule struct {
+	name      string
+	action    PolicyAction
+	limit     int
+	tag       string
+	ips       map[string]bool
+	nets      []*net.IPNet
+	codes     map[string]bool
+	headers   map[string]string
+	window    *compiledWindow
+	limiter   *rateLimiter
+	matchesIP bool
+}
+
+type compiledWindow struct {
+	from, to int // minutes since midnight
+	days     [7]bool
+	anyDay   bool
+	loc      *time.Location
+}
+
+// Compile checks the policy and compiles its rules. IP and country
+// rules are validated like ToggleIPE and ToggleCountryE, except that
+// host names are rejected as policies don't resolve them.
+func (p *Policy) Compile() (*PolicyEngine, error) {
+	engine := &PolicyEngine{defaultAllowed: true}
+	switch p.Default {
+	case "", ActionAllow:
+	case ActionDeny:
+		engine.defaultAllowed = false
+	default:
+		return nil, fmt.Errorf("ip policy: %w: default action %q", ErrInvalidPolicy, p.Default)
+	}
+	for i, rule := range p.Rules {
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+		compiled, err := compileRule(name, rule)
+		if err != nil {
+			return nil, err
+		}
+		engine.rules = append(engine.rules, compiled)
+	}
+	return engine, nil
+}
+
+func compileRule(name string, rule PolicyRule) (*compiledRule, error) {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("ip policy: %w: rule %s: %s", ErrInvalidPolicy, name, fmt.Sprintf(format, args...))
+	}
+	r := &compiledRule{name: name, action: rule.Action, limit: rule.Limit, tag: rule.Tag}
+	switch rule.Action {
+	case ActionAllow, ActionDeny:
+	case ActionRateLimit:
+		if rule.Limit <= 0 {
+			return nil, invalid("rate_limit needs a positive limit")
+		}
+		r.limiter = newRateLimiter(time.Minute)
+	case ActionTag:
+		if rule.Tag == "" {
+			return nil, invalid("tag needs a tag")
+		}
+	default:
+		return nil, invalid("unknown action %q", rule.Action)
+	}
+	if len(rule.IPs) > 0 {
+		r.matchesIP = true
+		r.ips = map[string]bool{}
+		for _, str := range rule.IPs {
+			if ip := net.ParseIP(str); ip != nil {
+				r.ips[ip.String()] = true
+				continue
+			}
+			nets, ok := ruleNets(str)
+			if !ok {
+				return nil, &RuleError{Rule: str, Err: ErrInvalidCIDR}
+			}
+			r.nets = append(r.nets, nets...)
+		}
+	}
+	if len(rule.Countries) > 0 {
+		r.codes = map[string]bool{}
+		for _, code := range rule.Countries {
+			code = strings.ToUpper(code)
+			if !geoip.KnownCountry(code) {
+				return nil, &RuleError{Rule: code, Err: ErrUnknownCountryCode}
+			}
+			r.codes[code] = true
+		}
+	}
+	r.headers = rule.Headers
+	if rule.Time != nil {
+		window, err := compileWindow(rule.Time)
+		if err != nil {
+			return nil, invalid("%v", err)
+		}
+		r.window = window
+	}
+	return r, nil
+}
+
+func compileWindow(t *TimeWindow) (*compiledWindow, error) {
+	w := &compiledWindow{loc: time.UTC, anyDay: len(t.Days) == 0}
+	if t.Location != "" {
+		loc, err := time.LoadLocation(t.Location)
+		if err != nil {
+			return nil, err
+		}
+		w.loc = loc
+	}
+	for i, str := range []string{t.From, t.To} {
+		clock, err := time.Parse("15:04", str)
+		if err != nil {
+			return nil, fmt.Errorf("time %q is not 15:04", str)
+		}
+		minutes := clock.Hour()*60 + clock.Minute()
+		if i == 0 {
+			w.from = minutes
+		} else {
+			w.to = minutes
+		}
+	}
+	for _, day := range t.Days {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(day, d.String()[:3]) {
+				w.days[d], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+	}
+	return w, nil
+}
+
+func (w *compiledWindow) contains(now time.Time) bool {
+	now = now.In(w.loc)
+	if !w.anyDay && !w.days[now.Weekday()] {
+		return false
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	if w.from < w.to {
+		return minutes >= w.from && minutes < w.to
+	}
+	return minutes >= w.from || minutes < w.to
+}
+
+// request is what rules match on, the country is looked up once and
+// only when a rule needs it
+type request struct {
+	c       ctx.Context
+	ip      net.IP
+	now     time.Time
+	code    string
+	hasCode bool
+}
+
+func (r *request) country() string {
+	if !r.hasCode {
+		r.code, r.hasCode = geoip.CountryByIP(r.ip), true
+	}
+	return r.code
+}
+
+func (r *compiledRule) matches(req *request) bool {
+	if r.matchesIP {
+		if req.ip == nil {
+			return false
+		}
+		if !r.ips[req.ip.String()] && !r.matchNets(req.ip) {
+			return false
+		}
+	}
+	if r.codes != nil && (req.ip == nil || !r.codes[req.country()]) {
+		return false
+	}
+	for key, value := range r.headers {
+		header := req.c.GetHeader(key)
+		if len(header) == 0 || (value != "" && string(header) != value) {
+			return false
+		}
+	}
+	if r.window != nil && !r.window.contains(req.now) {
+		return false
+	}
+	return true
+}
+
+func (r *compiledRule) matchNets(ip net.IP) bool {
+	for _, nt := range r.nets {
+		if nt.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide runs the policy for a request from ipStr, c provides the
+// headers.
+func (e *PolicyEngine) Decide(c ctx.Context, ipStr string) PolicyDecision {
+	return e.decideAt(c, ipStr, time.Now())
+}
+
+// decideAt is Decide at the time now, which time windows match on
+func (e *PolicyEngine) decideAt(c ctx.Context, ipStr string, now time.Time) PolicyDecision {
+	req := &request{c: c, ip: net.ParseIP(ipStr), now: now}
+	var decision PolicyDecision
+	for _, rule := range e.rules {
+		if !rule.matches(req) {
+			continue
+		}
+		switch rule.action {
+		case ActionAllow, ActionDeny:
+			decision.Allowed = rule.action == ActionAllow
+			decision.Rule = rule.name
+			return decision
+		case ActionRateLimit:
+			if !rule.limiter.allow(ipStr, rule.limit) {
+				decision.RateLimited = true
+				decision.Rule = rule.name
+				return decision
+			}
+		case ActionTag:
+			decision.Tags = append(decision.Tags, rule.tag)
+		}
+	}
+	decision.Allowed = e.defaultAllowed
+	return decision
+}
+
+// NewPolicyFilter returns a middleware enforcing the policy instead of
+// the rules of NewFilter. Only the IPContextKey, ErrorHandler and
+// RateLimitHandler of cfg are used. Tags are stored under PolicyTagsKey.
+func NewPolicyFilter(e *PolicyEngine, cfg ...Config) HandlerFunc {
+	var opts Config
+	if len(cfg) > 0 {
+		opts = cfg[0]
+	}
+	opts.setDefaultKeys()
+	opts.setDefaultHandlers()
+	return func(cx context.Context, c ctx.Context) {
+		decision := e.Decide(c, opts.remoteIP(c))
+		if len(decision.Tags) > 0 {
+			c.Set(PolicyTagsKey, decision.Tags)
+		}
+		if decision.RateLimited {
+			opts.RateLimitHandler(cx, c)
+			return
+		}
+		if !decision.Allowed {
+			opts.ErrorHandler(cx, c)
+			return
+		}
+		c.Next(cx)
+	}
+}
@@ -0,0 +1,223 @@
+package ip
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/oarkflow/ip/consts"
+	"github.com/oarkflow/ip/ctx/ctxtest"
+)
+
+func compilePolicy(t *testing.T, p Policy) *PolicyEngine {
+	t.Helper()
+	engine, err := p.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(`{
+		"default": "deny",
+		"rules": [{"name": "office", "ips": ["10.1.*.*"], "action": "allow"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Default != ActionDeny || len(p.Rules) != 1 || p.Rules[0].IPs[0] != "10.1.*.*" {
+		t.Errorf("parsed %+v", p)
+	}
+	for _, str := range []string{
+		`{"rules": [{"action": "allow", "ip": ["10.0.0.1"]}]}`,
+		`{"defaults": "deny", "rules": []}`,
+		`{"rules": [`,
+	} {
+		if _, err := ParsePolicy(strings.NewReader(str)); !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("ParsePolicy(%s) = %v, want ErrInvalidPolicy", str, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Policy
+		want error
+	}{
+		{"default", Policy{Default: "maybe"}, ErrInvalidPolicy},
+		{"action", Policy{Rules: []PolicyRule{{Action: "drop"}}}, ErrInvalidPolicy},
+		{"limit", Policy{Rules: []PolicyRule{{Action: ActionRateLimit}}}, ErrInvalidPolicy},
+		{"tag", Policy{Rules: []PolicyRule{{Action: ActionTag}}}, ErrInvalidPolicy},
+		{"ip", Policy{Rules: []PolicyRule{{Action: ActionDeny, IPs: []string{"10.0.0.1O"}}}}, ErrInvalidCIDR},
+		{"host name", Policy{Rules: []PolicyRule{{Action: ActionDeny, IPs: []string{"example.com"}}}}, ErrInvalidCIDR},
+		{"country", Policy{Rules: []PolicyRule{{Action: ActionDeny, Countries: []string{"XX"}}}}, ErrUnknownCountryCode},
+		{"time", Policy{Rules: []PolicyRule{{Action: ActionDeny, Time: &TimeWindow{From: "25:00", To: "06:00"}}}}, ErrInvalidPolicy},
+		{"day", Policy{Rules: []PolicyRule{{Action: ActionDeny, Time: &TimeWindow{From: "08:00", To: "18:00", Days: []string{"funday"}}}}}, ErrInvalidPolicy},
+		{"location", Policy{Rules: []PolicyRule{{Action: ActionDeny, Time: &TimeWindow{From: "08:00", To: "18:00", Location: "Mars/Olympus"}}}}, ErrInvalidPolicy},
+	}
+	for _, tt := range tests {
+		if _, err := tt.p.Compile(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 6, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		window TimeWindow
+		now    time.Time
+		want   bool
+	}{
+		{"before", TimeWindow{From: "08:00", To: "18:00"}, at(3, "07:59"), false},
+		{"from", TimeWindow{From: "08:00", To: "18:00"}, at(3, "08:00"), true},
+		{"before to", TimeWindow{From: "08:00", To: "18:00"}, at(3, "17:59"), true},
+		{"to", TimeWindow{From: "08:00", To: "18:00"}, at(3, "18:00"), false},
+		{"overnight evening", TimeWindow{From: "22:00", To: "06:00"}, at(3, "23:00"), true},
+		{"overnight morning", TimeWindow{From: "22:00", To: "06:00"}, at(3, "05:59"), true},
+		{"overnight end", TimeWindow{From: "22:00", To: "06:00"}, at(3, "06:00"), false},
+		{"overnight noon", TimeWindow{From: "22:00", To: "06:00"}, at(3, "12:00"), false},
+		{"whole day", TimeWindow{From: "00:00", To: "00:00"}, at(3, "13:37"), true},
+		{"weekend day", TimeWindow{From: "08:00", To: "18:00", Days: []string{"sat", "Sun"}}, at(1, "12:00"), true},
+		{"week day", TimeWindow{From: "08:00", To: "18:00", Days: []string{"sat", "Sun"}}, at(3, "12:00"), false},
+		// the day is the one of the request, not the one the window
+		// started on
+		{"overnight from friday", TimeWindow{From: "22:00", To: "06:00", Days: []string{"fri"}}, at(1, "01:00"), false},
+		{"overnight on friday", TimeWindow{From: "22:00", To: "06:00", Days: []string{"fri"}}, at(7, "23:00"), true},
+		// 07:30 UTC is 09:30 in Berlin in June
+		{"location", TimeWindow{From: "08:00", To: "18:00", Location: "Europe/Berlin"}, at(3, "07:30"), true},
+		{"location before", TimeWindow{From: "08:00", To: "18:00", Location: "Europe/Berlin"}, at(3, "05:30"), false},
+	}
+	for _, tt := range tests {
+		w, err := compileWindow(&tt.window)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := w.contains(tt.now); got != tt.want {
+			t.Errorf("%s: contains(%v) = %v, want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	engine := compilePolicy(t, Policy{
+		Default: ActionDeny,
+		Rules: []PolicyRule{
+			{Name: "bots", Headers: map[string]string{"X-Bot": ""}, Action: ActionTag, Tag: "bot"},
+			{Name: "banned", IPs: []string{"10.0.0.66"}, Action: ActionDeny},
+			{Name: "office", IPs: []string{"10.0.0.0/24", "192.168.1.10-192.168.1.20"}, Action: ActionAllow},
+			{Name: "partner", Headers: map[string]string{"X-Partner": "acme"}, Action: ActionAllow},
+			{Name: "us", Countries: []string{"us"}, Action: ActionTag, Tag: "us"},
+			{Name: "us limit", Countries: []string{"US"}, Action: ActionRateLimit, Limit: 1000},
+			{Name: "us hours", Countries: []string{"US"}, Time: &TimeWindow{From: "08:00", To: "18:00"}, Action: ActionAllow},
+		},
+	})
+	noon := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 6, 3, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		ip      string
+		headers map[string]string
+		now     time.Time
+		want    PolicyDecision
+	}{
+		{"office", "10.0.0.5", nil, noon, PolicyDecision{Allowed: true, Rule: "office"}},
+		{"range", "192.168.1.15", nil, noon, PolicyDecision{Allowed: true, Rule: "office"}},
+		{"out of range", "192.168.1.21", nil, noon, PolicyDecision{}},
+		// the first allow or deny rule decides
+		{"banned inside office", "10.0.0.66", nil, noon, PolicyDecision{Rule: "banned"}},
+		{"tagged", "10.0.0.5", map[string]string{"X-Bot": "1"}, noon, PolicyDecision{Allowed: true, Rule: "office", Tags: []string{"bot"}}},
+		{"empty header", "10.0.0.66", map[string]string{"X-Bot": ""}, noon, PolicyDecision{Rule: "banned"}},
+		{"header value", "1.1.1.1", map[string]string{"X-Partner": "acme"}, noon, PolicyDecision{Allowed: true, Rule: "partner"}},
+		{"other header value", "192.168.2.1", map[string]string{"X-Partner": "other"}, noon, PolicyDecision{}},
+		{"country in hours", testIP, nil, noon, PolicyDecision{Allowed: true, Rule: "us hours", Tags: []string{"us"}}},
+		{"country after hours", testIP, nil, night, PolicyDecision{Tags: []string{"us"}}},
+		{"tags in order", testIP, map[string]string{"X-Bot": "1"}, night, PolicyDecision{Tags: []string{"bot", "us"}}},
+		{"invalid ip", "nope", nil, noon, PolicyDecision{}},
+	}
+	for _, tt := range tests {
+		c := ctxtest.New(tt.ip)
+		for key, value := range tt.headers {
+			c.WithHeader(key, value)
+		}
+		got := engine.decideAt(c, tt.ip, tt.now)
+		if got.Allowed != tt.want.Allowed || got.RateLimited != tt.want.RateLimited ||
+			got.Rule != tt.want.Rule || !slices.Equal(got.Tags, tt.want.Tags) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecideRateLimit(t *testing.T) {
+	engine := compilePolicy(t, Policy{Rules: []PolicyRule{
+		{Name: "limit", IPs: []string{"10.0.0.0/8"}, Action: ActionRateLimit, Limit: 2},
+		{Name: "after", IPs: []string{"10.0.0.0/8"}, Action: ActionTag, Tag: "seen"},
+	}})
+	for i := 1; i <= 3; i++ {
+		got := engine.Decide(ctxtest.New("10.0.0.1"), "10.0.0.1")
+		// within the limit the evaluation continues to the next rule
+		if i <= 2 && (!got.Allowed || got.RateLimited || !slices.Equal(got.Tags, []string{"seen"})) {
+			t.Errorf("request %d: %+v", i, got)
+		}
+		if i == 3 && (got.Allowed || !got.RateLimited || got.Rule != "limit" || got.Tags != nil) {
+			t.Errorf("request %d: %+v, want rate limited by limit", i, got)
+		}
+	}
+	// the limit is per IP
+	if got := engine.Decide(ctxtest.New("10.0.0.2"), "10.0.0.2"); got.RateLimited {
+		t.Errorf("other IP rate limited: %+v", got)
+	}
+}
+
+func TestNewPolicyFilter(t *testing.T) {
+	engine := compilePolicy(t, Policy{
+		Default: ActionDeny,
+		Rules: []PolicyRule{
+			{IPs: []string{"10.0.0.0/8"}, Action: ActionTag, Tag: "internal"},
+			{Name: "limit", IPs: []string{"10.0.0.2"}, Action: ActionRateLimit, Limit: 1},
+			{IPs: []string{"10.0.0.0/8"}, Action: ActionAllow},
+		},
+	})
+	handler := NewPolicyFilter(engine, Config{IPContextKey: "client_ip"})
+	tests := []struct {
+		name     string
+		ip       string
+		code     int // 0 when passed through
+		tags     []string
+		requests int
+	}{
+		{"allowed", "10.0.0.1", 0, []string{"internal"}, 1},
+		{"denied by default", "1.1.1.1", consts.StatusServiceUnavailable, nil, 1},
+		{"rate limited", "10.0.0.2", consts.StatusTooManyRequests, []string{"internal"}, 2},
+	}
+	for _, tt := range tests {
+		var c *ctxtest.Context
+		for i := 0; i < tt.requests; i++ {
+			c = ctxtest.New(tt.ip)
+			handler(context.Background(), c)
+		}
+		code, _ := c.Abort()
+		if c.Aborted() != (tt.code != 0) || c.NextCalled() == (tt.code != 0) || code != tt.code {
+			t.Errorf("%s: aborted %v with %d, next called %v, want %d", tt.name, c.Aborted(), code, c.NextCalled(), tt.code)
+		}
+		values := c.Values()
+		if values["client_ip"] != tt.ip {
+			t.Errorf("%s: ip %v stored, want %s", tt.name, values["client_ip"], tt.ip)
+		}
+		tags, _ := values[PolicyTagsKey].([]string)
+		if !slices.Equal(tags, tt.tags) {
+			t.Errorf("%s: tags %v, want %v", tt.name, tags, tt.tags)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package ip
+
+import (
+	"github.com/oarkflow/ip/geoip"
+)
+
+// Provider presets for UseProvider, see geoip.Provider.
+var (
+	Cloudflare = geoip.Cloudflare
+	AWSALB     = geoip.AWSALB
+	GCPLB      = geoip.GCPLB
+	Fastly     = geoip.Fastly
+	Akamai     = geoip.Akamai
+)
+
+// UseProvider makes FromRequest, Detect and the filter read the client
+// IP the way the given load balancer or CDN passes it.
+func UseProvider(p geoip.Provider) {
+	geoip.UseProvider(p)
+}
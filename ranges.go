@@ -0,0 +1,177 @@
+package ip
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// expandIPRule normalizes the legacy allowlist notations accepted by
+// ToggleIP into CIDRs:
+//
+//	10.1.*.*                      -> 10.1.0.0/16
+//	192.168.1.10-192.168.1.50     -> 192.168.1.10/31, 192.168.1.12/30, ...
+//
+// Wildcards are IPv4 only and must be trailing, ranges work for both
+// IPv4 and IPv6 as long as both ends are of the same family.
+func expandIPRule(str string) ([]string, bool) {
+	str = strings.TrimSpace(str)
+	if strings.Contains(str, "*") {
+		cidr, ok := wildcardToCIDR(str)
+		if !ok {
+			return nil, false
+		}
+		return []string{cidr}, true
+	}
+	if from, to, found := strings.Cut(str, "-"); found {
+		start, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return nil, false
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return nil, false
+		}
+		return rangeToCIDRs(start.Unmap(), end.Unmap())
+	}
+	return nil, false
+}
+
+func wildcardToCIDR(str string) (string, bool) {
+	parts := strings.Split(str, ".")
+	if len(parts) != 4 {
+		return "", false
+	}
+	var octets [4]byte
+	fixed := 0
+	for i, part := range parts {
+		if part == "*" {
+			continue
+		}
+		// wildcards must be trailing (10.*.1.* is not a prefix)
+		if fixed != i {
+			return "", false
+		}
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return "", false
+		}
+		octets[i] = byte(n)
+		fixed++
+	}
+	return netip.PrefixFrom(netip.AddrFrom4(octets), fixed*8).String(), true
+}
+
+// rangeToCIDRs returns the smallest list of prefixes covering start..end
+func rangeToCIDRs(start, end netip.Addr) ([]string, bool) {
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return nil, false
+	}
+	var cidrs []string
+	for {
+		// widest prefix starting at start that does not overshoot end
+		bits := start.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(start, bits-1).Masked()
+			if p.Addr() != start || end.Less(lastAddr(p)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(start, bits)
+		cidrs = append(cidrs, p.String())
+		last := lastAddr(p)
+		if last == end {
+			return cidrs, true
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the last address contained in p
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 12
+	}
+	for i := offset + p.Bits()/8; i < 16; i++ {
+		netBits := p.Bits() - (i-offset)*8
+		if netBits > 0 {
+			b[i] |= 0xff >> netBits
+		} else {
+			b[i] = 0xff
+		}
+	}
+	if p.Addr().Is4() {
+		return netip.AddrFrom4([4]byte(b[12:]))
+	}
+	return netip.AddrFrom16(b)
+}
+
+// isHostName reports if an IP rule is a fully qualified DNS name,
+// which ToggleIP turns into a host rule. It needs at least two labels
+// and a top level domain of letters (or an IDN one), so typos like
+// 10.0.0.1O or single words like not-an-ip stay invalid rules.
+func isHostName(str string) bool {
+	str = strings.TrimSuffix(str, ".")
+	if len(str) > 253 {
+		return false
+	}
+	labels := strings.Split(str, ".")
+	if len(labels) < 2 || !isTLD(labels[len(labels)-1]) {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isTLD(label string) bool {
+	if strings.HasPrefix(strings.ToLower(label), "xn--") {
+		return true
+	}
+	if len(label) < 2 {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleNets parses an IP rule in any notation accepted by ToggleIP
+// into the networks it covers
+func ruleNets(str string) ([]*net.IPNet, bool) {
+	if _, nt, err := net.ParseCIDR(str); err == nil {
+		return []*net.IPNet{nt}, true
+	}
+	if ip := net.ParseIP(str); ip != nil {
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+		return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(bits, bits)}}, true
+	}
+	cidrs, ok := expandIPRule(str)
+	if !ok {
+		return nil, false
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, nt, _ := net.ParseCIDR(cidr)
+		nets = append(nets, nt)
+	}
+	return nets, true
+}
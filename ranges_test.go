@@ -0,0 +1,92 @@
+package ip
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestIsHostName(t *testing.T) {
+	tests := []struct {
+		str  string
+		want bool
+	}{
+		{"example.com", true},
+		{"office.example.co.uk", true},
+		{"example.com.", true},
+		{"xn--d1acufc.xn--p1ai", true},
+		{"localhost", false},
+		{"not-an-ip", false},
+		{"10.0.0.1O", false},
+		{"10.1.2", false},
+		{"example.c", false},
+		{"a..com", false},
+		{"-a.com", false},
+		{"foo_bar.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isHostName(tt.str); got != tt.want {
+			t.Errorf("isHostName(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestToggleIPEInvalidRules(t *testing.T) {
+	f := newFilter(Config{})
+	t.Cleanup(f.Close)
+	for _, str := range []string{"not-an-ip", "10.0.0.1O", "localhost", "10.1.*.5"} {
+		if err := f.AllowIPE(str); !errors.Is(err, ErrInvalidCIDR) {
+			t.Errorf("AllowIPE(%q) = %v, want ErrInvalidCIDR", str, err)
+		}
+	}
+	// .invalid never resolves
+	if err := f.AllowIPE("office.invalid"); !errors.Is(err, ErrUnresolvableHost) {
+		t.Errorf("AllowIPE of an unresolvable host = %v, want ErrUnresolvableHost", err)
+	}
+	if len(f.hosts) != 0 {
+		t.Errorf("rules kept for invalid entries: %v", f.hosts)
+	}
+}
+
+func TestExpandIPRule(t *testing.T) {
+	tests := []struct {
+		str  string
+		want []string // nil when rejected
+	}{
+		{"10.1.*.*", []string{"10.1.0.0/16"}},
+		{"10.*.*.*", []string{"10.0.0.0/8"}},
+		{"*.*.*.*", []string{"0.0.0.0/0"}},
+		{"10.1.2.*", []string{"10.1.2.0/24"}},
+		{"10.*.1.*", nil},
+		{"*.1.2.3", nil},
+		{"10.1.*", nil},
+		{"10.256.*.*", nil},
+		{"192.168.1.10-192.168.1.50", []string{
+			"192.168.1.10/31", "192.168.1.12/30", "192.168.1.16/28",
+			"192.168.1.32/28", "192.168.1.48/31", "192.168.1.50/32",
+		}},
+		{"192.168.1.10 - 192.168.1.11", []string{"192.168.1.10/31"}},
+		{"10.0.0.5-10.0.0.5", []string{"10.0.0.5/32"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"10.0.0.0-10.255.255.255", []string{"10.0.0.0/8"}},
+		{"10.0.0.255-10.0.1.0", []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{"10.0.0.9-10.0.0.1", nil},
+		{"2001:db8::-2001:db8::ffff", []string{"2001:db8::/112"}},
+		{"2001:db8::1-2001:db8::1", []string{"2001:db8::1/128"}},
+		{"2001:db8::1-2001:db8::4", []string{"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/128"}},
+		{"::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		// IPv4-mapped addresses count as IPv4
+		{"::ffff:10.0.0.1-10.0.0.2", []string{"10.0.0.1/32", "10.0.0.2/32"}},
+		{"10.0.0.1-2001:db8::1", nil},
+		{"2001:db8::1-10.0.0.1", nil},
+		{"10.0.0.1-", nil},
+		{"10.0.0.1", nil},
+	}
+	for _, tt := range tests {
+		got, ok := expandIPRule(tt.str)
+		if ok != (tt.want != nil) || !slices.Equal(got, tt.want) {
+			t.Errorf("expandIPRule(%q) = %v, %v, want %v", tt.str, got, ok, tt.want)
+		}
+	}
+}
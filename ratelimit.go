@@ -0,0 +1,50 @@
+package ip
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a fixed window request counter keyed by IP.
+type rateLimiter struct {
+	hits      map[string]*rateWindow
+	lastSweep time.Time
+	window    time.Duration
+	mut       sync.Mutex
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		hits:      map[string]*rateWindow{},
+		lastSweep: time.Now(),
+		window:    window,
+	}
+}
+
+// allow counts a request for key and reports if it is still within limit
+func (r *rateLimiter) allow(key string, limit int) bool {
+	now := time.Now()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	// drop expired windows so the map doesn't grow forever
+	if now.Sub(r.lastSweep) > r.window {
+		for k, w := range r.hits {
+			if now.Sub(w.start) > r.window {
+				delete(r.hits, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	w, ok := r.hits[key]
+	if !ok || now.Sub(w.start) > r.window {
+		w = &rateWindow{start: now}
+		r.hits[key] = w
+	}
+	w.count++
+	return w.count <= limit
+}
@@ -0,0 +1,90 @@
+package ip
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// RuleStat is the usage of a single rule as reported by RuleStats.
+type RuleStat struct {
+	// Kind is "ip", "host", "subnet" or "country"
+	Kind    string `json:"kind"`
+	Rule    string `json:"rule"`
+	Allowed bool   `json:"allowed"`
+	// Hits counts the decisions made by the rule
+	Hits uint64 `json:"hits"`
+	// LastMatched is zero when the rule never decided anything
+	LastMatched time.Time `json:"last_matched"`
+}
+
+// ruleStat counts the decisions of a rule, it is updated under the
+// filter's read lock so it's atomic
+type ruleStat struct {
+	hits atomic.Uint64
+	last atomic.Int64
+}
+
+func (r *ruleStat) hit() {
+	r.hits.Add(1)
+	r.last.Store(time.Now().UnixNano())
+}
+
+func (r *ruleStat) stat(kind, rule string, allowed bool) RuleStat {
+	s := RuleStat{Kind: kind, Rule: rule, Allowed: allowed, Hits: r.hits.Load()}
+	if last := r.last.Load(); last != 0 {
+		s.LastMatched = time.Unix(0, last)
+	}
+	return s
+}
+
+// statOf returns the counter of rule, creating it. Must be called with
+// the write lock held.
+func statOf(stats map[string]*ruleStat, rule string) *ruleStat {
+	stat, ok := stats[rule]
+	if !ok {
+		stat = &ruleStat{}
+		stats[rule] = stat
+	}
+	return stat
+}
+
+// lookupStat returns the counter of rule without creating it
+func lookupStat(stats map[string]*ruleStat, rule string) *ruleStat {
+	if stat, ok := stats[rule]; ok {
+		return stat
+	}
+	return &ruleStat{}
+}
+
+// RuleStats returns how often each rule decided a request, least
+// recently matched first, to find dead rules. Explain doesn't count.
+func (f *Filter) RuleStats() []RuleStat {
+	f.mut.RLock()
+	var stats []RuleStat
+	for ip, allowed := range f.ips {
+		stats = append(stats, lookupStat(f.ipStats, ip).stat("ip", ip, allowed))
+	}
+	for host, rule := range f.hosts {
+		stats = append(stats, rule.stat.stat("host", host, rule.allowed))
+	}
+	for _, subnet := range f.subnets {
+		stats = append(stats, subnet.stat.stat("subnet", subnet.str, subnet.allowed))
+	}
+	for code, allowed := range f.codes {
+		stats = append(stats, lookupStat(f.codeStats, code).stat("country", code, allowed))
+	}
+	f.mut.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].LastMatched.Equal(stats[j].LastMatched) {
+			return stats[i].LastMatched.Before(stats[j].LastMatched)
+		}
+		return stats[i].Hits < stats[j].Hits
+	})
+	return stats
+}
+
+// RuleStats returns how often each rule decided a request
+func RuleStats() []RuleStat {
+	return filter.RuleStats()
+}
@@ -0,0 +1,219 @@
+package ip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/oarkflow/ip/geoip"
+)
+
+// IssueKind classifies a problem found by Config.Validate.
+type IssueKind string
+
+const (
+	// IssueInvalid is an IP, CIDR or country code which can't be parsed
+	IssueInvalid IssueKind = "invalid"
+	// IssueContradictory is a rule which is both allowed and blocked
+	IssueContradictory IssueKind = "contradictory"
+	// IssueUnreachable is a rule which never decides anything because a
+	// broader rule always wins over it
+	IssueUnreachable IssueKind = "unreachable"
+)
+
+// ConfigIssue is a single problem found by Config.Validate.
+type ConfigIssue struct {
+	Kind    IssueKind `json:"kind"`
+	Field   string    `json:"field"`
+	Value   string    `json:"value"`
+	Message string    `json:"message"`
+}
+
+func (i ConfigIssue) String() string {
+	return fmt.Sprintf("%s %s %q: %s", i.Kind, i.Field, i.Value, i.Message)
+}
+
+type configRule struct {
+	field    string
+	value    string
+	prefixes []netip.Prefix
+	// key is the same for rules covering the same networks
+	key     string
+	allowed bool
+}
+
+// sameRule identifies the first rule with an action on some networks
+type sameRule struct {
+	key     string
+	allowed bool
+}
+
+// Validate reports invalid IPs, CIDRs and country codes, rules that are
+// both allowed and blocked, and subnet rules that can never decide
+// because a broader subnet always wins. NewFilter logs these issues
+// and otherwise ignores the offending entries.
+func (c Config) Validate() []ConfigIssue {
+	var issues []ConfigIssue
+	var rules []configRule
+	addRules := func(field string, values []string, allowed bool) {
+		for _, value := range values {
+			nets, ok := ruleNets(value)
+			if !ok && isHostName(value) {
+				// host rules resolve at run time, nothing to compare
+				continue
+			}
+			if !ok {
+				issues = append(issues, ConfigIssue{
+					Kind:    IssueInvalid,
+					Field:   field,
+					Value:   value,
+					Message: "not an IP, CIDR, wildcard, range or host name",
+				})
+				continue
+			}
+			rule := configRule{field: field, value: value, allowed: allowed}
+			keys := make([]string, len(nets))
+			for i, nt := range nets {
+				p := netPrefix(nt)
+				rule.prefixes = append(rule.prefixes, p)
+				keys[i] = p.String()
+			}
+			rule.key = strings.Join(keys, ",")
+			rules = append(rules, rule)
+		}
+	}
+	addRules("BlockedIPs", c.BlockedIPs, false)
+	addRules("AllowedIPs", c.AllowedIPs, true)
+	first := map[sameRule]int{}
+	byPrefix := map[netip.Prefix][]int{}
+	for j, b := range rules {
+		if i, ok := first[sameRule{b.key, !b.allowed}]; ok {
+			issues = append(issues, ConfigIssue{
+				Kind:    IssueContradictory,
+				Field:   b.field,
+				Value:   b.value,
+				Message: fmt.Sprintf("also listed in %s as %q", rules[i].field, rules[i].value),
+			})
+		}
+		if _, ok := first[sameRule{b.key, b.allowed}]; !ok {
+			first[sameRule{b.key, b.allowed}] = j
+		}
+		for _, p := range b.prefixes {
+			byPrefix[p] = append(byPrefix[p], j)
+		}
+	}
+	for i, a := range rules {
+		// single ips take precedence over subnets
+		if len(a.prefixes) == 1 && a.prefixes[0].IsSingleIP() {
+			continue
+		}
+		for _, j := range coveringRules(byPrefix, a.prefixes[0]) {
+			b := rules[j]
+			// allowed subnets take precedence over blocked ones, so
+			// only a subnet inside an allowed subnet or inside one with
+			// the same action is moot
+			if j == i || a.key == b.key || (a.allowed && !b.allowed) {
+				continue
+			}
+			if prefixesWithin(a.prefixes, b.prefixes) {
+				issues = append(issues, ConfigIssue{
+					Kind:    IssueUnreachable,
+					Field:   a.field,
+					Value:   a.value,
+					Message: fmt.Sprintf("covered by %s %q", b.field, b.value),
+				})
+			}
+		}
+	}
+	blocked := map[string]bool{}
+	checkCodes := func(field string, values []string) {
+		for _, code := range values {
+			if !geoip.KnownCountry(code) {
+				issues = append(issues, ConfigIssue{
+					Kind:    IssueInvalid,
+					Field:   field,
+					Value:   code,
+					Message: "unknown country code",
+				})
+				continue
+			}
+			// rate limited countries are allowed too, so only
+			// blocking conflicts with the other lists
+			if field == "BlockedCountries" {
+				blocked[code] = true
+				continue
+			}
+			if blocked[code] {
+				issues = append(issues, ConfigIssue{
+					Kind:    IssueContradictory,
+					Field:   field,
+					Value:   code,
+					Message: "also listed in BlockedCountries",
+				})
+			}
+		}
+	}
+	checkCodes("BlockedCountries", c.BlockedCountries)
+	checkCodes("AllowedCountries", c.AllowedCountries)
+	limited := make([]string, 0, len(c.CountryRateLimits))
+	for code := range c.CountryRateLimits {
+		limited = append(limited, code)
+	}
+	checkCodes("CountryRateLimits", limited)
+	if (c.BlockAnonymousProxies || c.BlockVPNs) && c.AnonymousIP == nil && c.AnonymousIPPath == "" {
+		field := "BlockVPNs"
+		if c.BlockAnonymousProxies {
+			field = "BlockAnonymousProxies"
+		}
+		issues = append(issues, ConfigIssue{
+			Kind:    IssueUnreachable,
+			Field:   field,
+			Value:   "true",
+			Message: "no AnonymousIP or AnonymousIPPath to look addresses up in",
+		})
+	}
+	return issues
+}
+
+// netPrefix converts a network of ruleNets, IPv4 ones stay IPv4
+func netPrefix(nt *net.IPNet) netip.Prefix {
+	ones, _ := nt.Mask.Size()
+	addr, _ := netip.AddrFromSlice(nt.IP)
+	if addr.Is4In6() && ones >= 96 {
+		addr, ones = addr.Unmap(), ones-96
+	}
+	return netip.PrefixFrom(addr, ones).Masked()
+}
+
+// coveringRules returns the indexes of the rules with a prefix
+// containing p, walking up its enclosing prefixes instead of comparing
+// against every rule
+func coveringRules(byPrefix map[netip.Prefix][]int, p netip.Prefix) []int {
+	var found []int
+	for bits := p.Bits(); bits >= 0; bits-- {
+		found = append(found, byPrefix[netip.PrefixFrom(p.Addr(), bits).Masked()]...)
+	}
+	sort.Ints(found)
+	return slices.Compact(found)
+}
+
+// prefixesWithin reports whether every prefix of inner is contained in
+// one of the outer prefixes
+func prefixesWithin(inner, outer []netip.Prefix) bool {
+	for _, in := range inner {
+		covered := false
+		for _, out := range outer {
+			if out.Bits() <= in.Bits() && out.Contains(in.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
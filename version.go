@@ -0,0 +1,55 @@
+package ip
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/oarkflow/ip/geoip"
+)
+
+const modulePath = "github.com/oarkflow/ip"
+
+// BuildInfo describes the running version of the package for
+// diagnostics endpoints and bug reports. DBLoadedAt is nil while the
+// embedded database is in use.
+type BuildInfo struct {
+	Module       string              `json:"module"`
+	Version      string              `json:"version"`
+	DBVersion    string              `json:"db_version"`
+	DBLoadedAt   *time.Time          `json:"db_loaded_at,omitempty"`
+	Features     []string            `json:"features"`
+	Attributions []geoip.Attribution `json:"attributions"`
+}
+
+// Version returns the module version, the version of the loaded
+// database and the enabled features. Version is "(devel)" when the module is
+// the main module or unknown when built without module support.
+func Version() BuildInfo {
+	info := BuildInfo{
+		Module:       modulePath,
+		Version:      "unknown",
+		DBVersion:    geoip.DatabaseVersion(),
+		Features:     []string{"country"},
+		Attributions: geoip.Attributions(),
+	}
+	if loadedAt := geoip.DatabaseLoadedAt(); !loadedAt.IsZero() {
+		info.DBLoadedAt = &loadedAt
+	}
+	if geoip.IPv6Enabled() {
+		info.Features = append(info.Features, "ipv6")
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if build.Main.Path == modulePath {
+			info.Version = build.Main.Version
+		}
+		for _, dep := range build.Deps {
+			if dep.Path == modulePath {
+				info.Version = dep.Version
+				if dep.Replace != nil {
+					info.Version = dep.Replace.Version
+				}
+			}
+		}
+	}
+	return info
+}